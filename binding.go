@@ -0,0 +1,94 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"stash.kopano.io/kgol/kustomer/license"
+)
+
+// MachineIDFiles are the files where the machine ID is read from, first found
+// wins.
+var MachineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// A HostIdentity identifies the host licenses are loaded on, to be matched
+// against license bindings.
+type HostIdentity struct {
+	// MachineID is the SHA256 hex hash of the machine ID.
+	MachineID string
+	Hostname  string
+	ClusterID string
+}
+
+// NewHostIdentity returns the HostIdentity of the current host with the
+// provided cluster ID. A missing machine ID is not an error and results in
+// an empty MachineID.
+func NewHostIdentity(clusterID string) (*HostIdentity, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+
+	h := &HostIdentity{
+		Hostname:  hostname,
+		ClusterID: clusterID,
+	}
+
+	for _, fn := range MachineIDFiles {
+		data, readErr := ioutil.ReadFile(fn)
+		if readErr != nil {
+			if os.IsNotExist(readErr) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read machine ID: %w", readErr)
+		}
+		if machineID := strings.TrimSpace(string(data)); machineID != "" {
+			sum := sha256.Sum256([]byte(machineID))
+			h.MachineID = hex.EncodeToString(sum[:])
+			break
+		}
+	}
+
+	return h, nil
+}
+
+// CheckBinding checks if the provided binding matches the associated host
+// identity and if not returns the binding claim which did not match. A nil
+// binding always matches, a nil HostIdentity matches no binding claim.
+func (h *HostIdentity) CheckBinding(b *license.Binding) (string, bool) {
+	if b == nil {
+		return "", true
+	}
+	if h == nil {
+		h = &HostIdentity{}
+	}
+	if len(b.MachineIDs) > 0 && (h.MachineID == "" || !containsString(b.MachineIDs, h.MachineID)) {
+		return "mid", false
+	}
+	if len(b.Hostnames) > 0 {
+		matched := false
+		for _, pattern := range b.Hostnames {
+			if ok, _ := filepath.Match(pattern, h.Hostname); ok && h.Hostname != "" {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "host", false
+		}
+	}
+	if len(b.ClusterIDs) > 0 && (h.ClusterID == "" || !containsString(b.ClusterIDs, h.ClusterID)) {
+		return "cid", false
+	}
+	return "", true
+}
@@ -0,0 +1,274 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Extended key usage object identifiers, which can be used by name.
+var extKeyUsageOIDs = map[string]asn1.ObjectIdentifier{
+	"any":             {2, 5, 29, 37, 0},
+	"serverAuth":      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	"clientAuth":      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	"codeSigning":     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	"emailProtection": {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	"timeStamping":    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "serverAuth",
+	x509.ExtKeyUsageClientAuth:      "clientAuth",
+	x509.ExtKeyUsageCodeSigning:     "codeSigning",
+	x509.ExtKeyUsageEmailProtection: "emailProtection",
+	x509.ExtKeyUsageTimeStamping:    "timeStamping",
+}
+
+// DefaultLicenseCertExtKeyUsages are the extended key usages accepted by
+// default for certificates signing licenses.
+var DefaultLicenseCertExtKeyUsages = []asn1.ObjectIdentifier{
+	extKeyUsageOIDs["serverAuth"],
+	extKeyUsageOIDs["codeSigning"],
+}
+
+var (
+	errCertificateRevoked = errors.New("certificate is revoked")
+	errCertificateUsage   = errors.New("certificate extended key usage not accepted")
+	errCertificatePolicy  = errors.New("certificate policy not accepted")
+	errCRLOutdated        = errors.New("certificate revocation list is outdated")
+)
+
+// ParseObjectIdentifier parses the provided dotted object identifier. Extended
+// key usages can also be given by name (for example codeSigning).
+func ParseObjectIdentifier(s string) (asn1.ObjectIdentifier, error) {
+	if oid, ok := extKeyUsageOIDs[s]; ok {
+		return oid, nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid object identifier: %v", s)
+	}
+	oid := make(asn1.ObjectIdentifier, 0, len(parts))
+	for _, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid object identifier: %v", s)
+		}
+		oid = append(oid, v)
+	}
+	return oid, nil
+}
+
+// LoadCertificates loads all PEM encoded certificates from the file with the
+// provided name.
+func LoadCertificates(fn string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, parseErr := x509.ParseCertificate(block.Bytes)
+		if parseErr != nil {
+			return nil, fmt.Errorf("failed to parse certificate in %s: %w", fn, parseErr)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", fn)
+	}
+
+	return certs, nil
+}
+
+// LoadCRL loads the PEM or DER encoded certificate revocation list from the
+// file with the provided name.
+func LoadCRL(fn string) (*pkix.CertificateList, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL in %s: %w", fn, err)
+	}
+	return crl, nil
+}
+
+// certificateChain returns the certificates of the x5c header of the provided
+// JWS in compact serialization, leaf first.
+func certificateChain(signed []byte) ([]*x509.Certificate, error) {
+	parts := bytes.SplitN(signed, []byte("."), 2)
+	protected, err := base64.RawURLEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode header: %w", err)
+	}
+	header := &struct {
+		X5C []string `json:"x5c"`
+	}{}
+	if err = json.Unmarshal(protected, header); err != nil {
+		return nil, fmt.Errorf("failed to parse header: %w", err)
+	}
+	if len(header.X5C) == 0 {
+		return nil, errors.New("no x509 certificates available in header")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(header.X5C))
+	for _, encoded := range header.X5C {
+		der, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("failed to decode x5c certificate: %w", decodeErr)
+		}
+		cert, parseErr := x509.ParseCertificate(der)
+		if parseErr != nil {
+			return nil, fmt.Errorf("failed to parse x5c certificate: %w", parseErr)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// verifyCertificateChain verifies the provided certificates (leaf first) with
+// the provided roots and the associated loader's Intermediates at the provided
+// time and returns the leaf certificate if valid.
+func (ll *LicensesLoader) verifyCertificateChain(certs []*x509.Certificate, roots *x509.CertPool, signedAt time.Time) (*x509.Certificate, error) {
+	if roots == nil {
+		return nil, errors.New("no root certificates")
+	}
+	leaf := certs[0]
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range ll.Intermediates {
+		intermediates.AddCert(cert)
+	}
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   signedAt,
+		// Extended key usage is checked for the leaf only, see below.
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ll.checkCertificateUsage(leaf); err != nil {
+		return nil, err
+	}
+	if err = ll.checkCertificatePolicy(leaf); err != nil {
+		return nil, err
+	}
+	if len(ll.CRLs) > 0 {
+		// Any chain which is not revoked is good.
+		now := time.Now()
+		for _, chain := range chains {
+			if err = ll.checkCertificateChainRevocation(chain, now); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return leaf, nil
+}
+
+func (ll *LicensesLoader) checkCertificateUsage(cert *x509.Certificate) error {
+	if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+		// No extended key usage means any.
+		return nil
+	}
+
+	usages := ll.CertExtKeyUsages
+	if len(usages) == 0 {
+		usages = DefaultLicenseCertExtKeyUsages
+	}
+	have := append([]asn1.ObjectIdentifier{}, cert.UnknownExtKeyUsage...)
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageAny {
+			return nil
+		}
+		if name, ok := extKeyUsageNames[usage]; ok {
+			have = append(have, extKeyUsageOIDs[name])
+		}
+	}
+	if containsObjectIdentifier(have, usages) {
+		return nil
+	}
+	return errCertificateUsage
+}
+
+func (ll *LicensesLoader) checkCertificatePolicy(cert *x509.Certificate) error {
+	if len(ll.CertPolicies) == 0 {
+		return nil
+	}
+	if containsObjectIdentifier(cert.PolicyIdentifiers, ll.CertPolicies) {
+		return nil
+	}
+	return errCertificatePolicy
+}
+
+// checkCertificateChainRevocation checks the provided chain against the CRLs
+// of the associated loader. CRLs of an issuer of the chain must be current at
+// the provided time.
+func (ll *LicensesLoader) checkCertificateChainRevocation(chain []*x509.Certificate, now time.Time) error {
+	for idx, cert := range chain[:len(chain)-1] {
+		issuer := chain[idx+1]
+		for _, crl := range ll.CRLs {
+			if issuer.CheckCRLSignature(crl) != nil {
+				// Not issued by this issuer.
+				continue
+			}
+			if crl.HasExpired(now) {
+				return errCRLOutdated
+			}
+			for _, revoked := range crl.TBSCertList.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return errCertificateRevoked
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func containsObjectIdentifier(have []asn1.ObjectIdentifier, want []asn1.ObjectIdentifier) bool {
+	for _, a := range have {
+		for _, b := range want {
+			if a.Equal(b) {
+				return true
+			}
+		}
+	}
+	return false
+}
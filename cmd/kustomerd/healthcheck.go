@@ -34,6 +34,7 @@ func commandHealthcheck() *cobra.Command {
 
 	healthcheckCmd.Flags().StringVar(&listenPath, "listen-path", listenPath, "Path to unix socket for API requests")
 	healthcheckCmd.Flags().String("path", "/health-check", "URL path and optional parameters to health-check endpoint")
+	healthcheckCmd.Flags().Bool("ready", false, "Check readiness with the /health/ready endpoint, unless path is set")
 
 	return healthcheckCmd
 }
@@ -46,6 +47,9 @@ func healthcheck(cmd *cobra.Command, args []string) error {
 		Host:   "localhost",
 	}
 	uri.Path, _ = cmd.Flags().GetString("path")
+	if ready, _ := cmd.Flags().GetBool("ready"); ready && !cmd.Flags().Changed("path") {
+		uri.Path = "/health/ready"
+	}
 
 	var dialer net.Dialer
 	client := http.Client{
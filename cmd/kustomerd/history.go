@@ -0,0 +1,152 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"stash.kopano.io/kgol/kustomer/server"
+	api "stash.kopano.io/kgol/kustomer/server/api-v1"
+)
+
+func commandHistory() *cobra.Command {
+	historyCmd := &cobra.Command{
+		Use:   "history",
+		Short: "Show history of effective license claims",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := history(cmd, args); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	historyCmd.Flags().StringVar(&listenPath, "listen-path", listenPath, "Path to unix socket for API requests")
+	historyCmd.Flags().String("since", "", "Only show changes at or after this time (RFC 3339, YYYY-MM-DD or a duration ago like 24h)")
+	historyCmd.Flags().String("until", "", "Only show changes at or before this time (RFC 3339, YYYY-MM-DD or a duration ago like 24h)")
+	historyCmd.Flags().Bool("json", false, "Output the history as JSON")
+
+	return historyCmd
+}
+
+func history(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	now := time.Now()
+
+	query := url.Values{}
+	for _, name := range []string{"since", "until"} {
+		value, _ := cmd.Flags().GetString(name)
+		if value == "" {
+			continue
+		}
+		t, err := parseHistoryTime(value, now)
+		if err != nil {
+			return fmt.Errorf("invalid %s value: %w", name, err)
+		}
+		query.Set(name, strconv.FormatInt(t.Unix(), 10))
+	}
+
+	uri := url.URL{
+		Scheme:   "http",
+		Host:     "localhost",
+		Path:     "/api/v1/history",
+		RawQuery: query.Encode(),
+	}
+
+	var dialer net.Dialer
+	client := http.Client{
+		Timeout: time.Second * 60,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, proto, addr string) (conn net.Conn, err error) {
+				return dialer.DialContext(ctx, "unix", listenPath)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	request, err := http.NewRequest(http.MethodGet, uri.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create history request: %v", err)
+	}
+
+	request.Header.Set("Connection", "close")
+	request.Header.Set("User-Agent", server.DefaultHTTPUserAgent)
+	request = request.WithContext(ctx)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("history request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(response.Body)
+		fmt.Fprint(os.Stderr, string(bodyBytes))
+
+		return fmt.Errorf("history failed with status: %v", response.StatusCode)
+	}
+
+	result := &api.HistoryResponse{}
+	if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to parse history response: %v", err)
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	for _, entry := range result.Entries {
+		fmt.Fprintf(os.Stdout, "%s (%s)\n", time.Unix(entry.Time, 0).Format(time.RFC3339), entry.Trigger)
+		if len(entry.Added) > 0 {
+			fmt.Fprintf(os.Stdout, "  added: %s\n", strings.Join(entry.Added, ", "))
+		}
+		if len(entry.Removed) > 0 {
+			fmt.Fprintf(os.Stdout, "  removed: %s\n", strings.Join(entry.Removed, ", "))
+		}
+		names := make([]string, 0, len(entry.Products))
+		for name := range entry.Products {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			claims, _ := json.Marshal(entry.Products[name].Claims)
+			fmt.Fprintf(os.Stdout, "  product %s: %s\n", name, claims)
+		}
+	}
+
+	return nil
+}
+
+// parseHistoryTime parses the provided value as RFC 3339 time, as date or as
+// duration before the provided time.
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is neither a time, date nor duration", value)
+	}
+	return now.Add(-d), nil
+}
@@ -0,0 +1,76 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/square/go-jose.v2"
+
+	"stash.kopano.io/kgol/kustomer"
+)
+
+var defaultHostKeyPath = "/etc/kopano/kustomerd-hostkey.jwk"
+
+func commandHostkey() *cobra.Command {
+	hostkeyCmd := &cobra.Command{
+		Use:   "hostkey",
+		Short: "Print the public host key for encrypted licenses",
+		Long:  "Print the public JWK of the host key, to be used when requesting encrypted licenses. With --generate, a new host key is created first.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := hostkey(cmd, args); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	hostkeyCmd.Flags().String("host-key", defaultHostKeyPath, "Path to the private host key JWK file")
+	hostkeyCmd.Flags().Bool("generate", false, "Generate a new host key, if the host key file does not exist")
+
+	return hostkeyCmd
+}
+
+func hostkey(cmd *cobra.Command, args []string) error {
+	keyPath, _ := cmd.Flags().GetString("host-key")
+	generate, _ := cmd.Flags().GetBool("generate")
+
+	var key *jose.JSONWebKey
+	if _, statErr := os.Stat(keyPath); generate && os.IsNotExist(statErr) {
+		var err error
+		key, err = kustomer.GenerateHostKey()
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(key, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode host key: %w", err)
+		}
+		if err = ioutil.WriteFile(keyPath, append(data, '\n'), 0600); err != nil {
+			return fmt.Errorf("failed to write host key: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "host key generated: %s\n", keyPath)
+	} else {
+		var err error
+		key, err = kustomer.LoadHostKey(keyPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	public := key.Public()
+	data, err := json.MarshalIndent(&public, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode public host key: %w", err)
+	}
+	fmt.Fprintln(os.Stdout, string(data))
+
+	return nil
+}
@@ -6,22 +6,129 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 
+	"github.com/coreos/go-systemd/v22/journal"
 	"github.com/sirupsen/logrus"
 )
 
-func newLogger(disableTimestamp bool, logLevelString string) (logrus.FieldLogger, error) {
+// Supported log formats and outputs.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logOutputStderr   = "stderr"
+	logOutputJournald = "journald"
+)
+
+func newLogger(disableTimestamp bool, logLevelString string, logFormat string, logOutput string) (logrus.FieldLogger, error) {
 	logLevel, err := logrus.ParseLevel(logLevelString)
 	if err != nil {
 		return nil, err
 	}
 
-	return &logrus.Logger{
-		Out: os.Stderr,
-		Formatter: &logrus.TextFormatter{
-			DisableTimestamp: disableTimestamp,
-		},
+	logger := &logrus.Logger{
+		Out:   os.Stderr,
+		Hooks: make(logrus.LevelHooks),
 		Level: logLevel,
-	}, nil
+	}
+
+	switch logFormat {
+	case logFormatText:
+		logger.Formatter = &logrus.TextFormatter{
+			DisableTimestamp: disableTimestamp,
+		}
+	case logFormatJSON:
+		logger.Formatter = &logrus.JSONFormatter{
+			DisableTimestamp: disableTimestamp,
+		}
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", logFormat)
+	}
+
+	switch logOutput {
+	case logOutputStderr:
+	case logOutputJournald:
+		if !journal.Enabled() {
+			return nil, fmt.Errorf("journald is not available")
+		}
+		logger.Out = ioutil.Discard
+		logger.AddHook(&journaldHook{})
+	default:
+		return nil, fmt.Errorf("unknown log output: %s", logOutput)
+	}
+
+	return logger, nil
+}
+
+// A journaldHook is a logrus hook which sends log entries to the systemd
+// journal, with the logrus fields as structured journal fields.
+type journaldHook struct{}
+
+// Levels implements the logrus.Hook interface.
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements the logrus.Hook interface.
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	vars := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		name := journaldFieldName(k)
+		if name == "" {
+			continue
+		}
+		if err, ok := v.(error); ok {
+			vars[name] = err.Error()
+		} else {
+			vars[name] = fmt.Sprint(v)
+		}
+	}
+
+	return journal.Send(entry.Message, journaldPriority(entry.Level), vars)
+}
+
+// journaldFieldName returns the journal field name for the provided logrus
+// field name, for example remote_uid becomes REMOTE_UID. Journal field names
+// must only contain upper case letters, digits and underscores and must not
+// start with an underscore. Returns empty string if there is no valid name.
+func journaldFieldName(k string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, k)
+	name = strings.TrimLeft(name, "_")
+	switch name {
+	case "MESSAGE", "PRIORITY":
+		// Never override the fields set by journal.Send.
+		return "KUSTOMERD_" + name
+	}
+	return name
+}
+
+// journaldPriority returns the journal priority for the provided logrus level.
+func journaldPriority(level logrus.Level) journal.Priority {
+	switch level {
+	case logrus.PanicLevel:
+		return journal.PriEmerg
+	case logrus.FatalLevel:
+		return journal.PriCrit
+	case logrus.ErrorLevel:
+		return journal.PriErr
+	case logrus.WarnLevel:
+		return journal.PriWarning
+	case logrus.InfoLevel:
+		return journal.PriInfo
+	default:
+		return journal.PriDebug
+	}
 }
@@ -0,0 +1,44 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestJournaldFieldName(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{"remote_uid", "REMOTE_UID"},
+		{"jti", "JTI"},
+		{"REMOTE_PID", "REMOTE_PID"},
+		{"http.status", "HTTP_STATUS"},
+		{"key-id", "KEY_ID"},
+		{"sub2", "SUB2"},
+		{"_hidden", "HIDDEN"},
+		{"__hidden", "HIDDEN"},
+		{".hidden", "HIDDEN"},
+		{"_SYSTEMD_UNIT", "SYSTEMD_UNIT"},
+		{"message", "KUSTOMERD_MESSAGE"},
+		{"MESSAGE", "KUSTOMERD_MESSAGE"},
+		{"_message", "KUSTOMERD_MESSAGE"},
+		{"priority", "KUSTOMERD_PRIORITY"},
+		{"message_id", "MESSAGE_ID"},
+		{"ü", ""},
+		{"größe", "GR__E"},
+		{"", ""},
+		{"_", ""},
+		{"...", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if name := journaldFieldName(tc.name); name != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, name)
+			}
+		})
+	}
+}
@@ -16,6 +16,8 @@ func main() {
 	cmd.RootCmd.AddCommand(commandServe())
 	cmd.RootCmd.AddCommand(commandHealthcheck())
 	cmd.RootCmd.AddCommand(commandReload())
+	cmd.RootCmd.AddCommand(commandHistory())
+	cmd.RootCmd.AddCommand(commandHostkey())
 
 	if err := cmd.RootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
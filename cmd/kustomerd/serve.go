@@ -8,31 +8,41 @@ package main
 import (
 	"context"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"fmt"
 	"math/rand"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	systemDaemon "github.com/coreos/go-systemd/v22/daemon"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"gopkg.in/square/go-jose.v2"
 	"stash.kopano.io/kgol/ksurveyclient-go/autosurvey"
 
+	"stash.kopano.io/kgol/kustomer"
 	"stash.kopano.io/kgol/kustomer/server"
 )
 
 var defaultCustomerClientSubmitURL = "https://kustomer.kopano.com/api/stats/v1/submit"
 
 var defaultTrusted = true
+var defaultJWKSTrusted = true
 var defaultInsecure = false
 var defaultSystemdNotify = false
 
 var globalSub = ""
-var licensesPath = "/etc/kopano/licenses"
+var licensesPaths = []string{"/etc/kopano/licenses"}
+var licensesEnvPrefix = "KOPANO_LICENSE_"
 var listenPath = "/run/kopano-kustomerd/api.sock"
+var statePath = "/var/lib/kopano-kustomerd"
+var hostKeyPath = ""
 
 func init() {
 	// Disable auto hashing of GUID values. We control this ourselves.
@@ -61,6 +71,7 @@ func init() {
 	if v := os.Getenv("KOPANO_KUSTOMERD_LICENSE_JWKS_URI"); v != "" {
 		server.DefaultLicenseJWKSURI = v
 		defaultTrusted = false
+		defaultJWKSTrusted = false
 	}
 	if v := os.Getenv("KOPANO_KUSTOMERD_LICENSE_SUB"); v != "" {
 		globalSub = strings.TrimSpace(v)
@@ -83,10 +94,45 @@ func commandServe() *cobra.Command {
 
 	serveCmd.Flags().Bool("log-timestamp", true, "Prefix each log line with timestamp")
 	serveCmd.Flags().String("log-level", "info", "Log level (one of panic, fatal, error, warn, info or debug)")
-	serveCmd.Flags().StringVar(&licensesPath, "licenses-path", licensesPath, "Path to the folder containing Kopano license files")
+	serveCmd.Flags().String("log-format", logFormatText, "Log format (one of text or json)")
+	serveCmd.Flags().String("log-output", logOutputStderr, "Log output (one of stderr or journald)")
+	serveCmd.Flags().Bool("strict-sub", false, "Only activate licenses for the configured sub (KOPANO_KUSTOMERD_LICENSE_SUB)")
+	serveCmd.Flags().String("cluster-id", "", "Cluster identifier of this installation, for licenses bound to a cluster")
+	serveCmd.Flags().StringArrayVar(&licensesPaths, "licenses-path", licensesPaths, "Path to a folder containing Kopano license files, in the form of PATH[:offline] (can be used multiple times, first wins)")
+	serveCmd.Flags().StringVar(&licensesEnvPrefix, "licenses-env-prefix", licensesEnvPrefix, "Prefix of environment variables containing Kopano licenses (empty to disable)")
+	serveCmd.Flags().StringArray("licenses-file", nil, "Path to a file containing Kopano licenses which is read once on startup (can be used multiple times)")
+	serveCmd.Flags().Bool("licenses-stdin", false, "Read Kopano licenses once from stdin on startup")
+	serveCmd.Flags().String("licenses-fetch-uri", "", "HTTPS URI to fetch current Kopano licenses from (empty to disable)")
+	serveCmd.Flags().String("licenses-fetch-path", "", "Path to the folder where fetched Kopano licenses are stored (default first licenses-path)")
+	serveCmd.Flags().Duration("licenses-fetch-interval", 6*time.Hour, "Interval to fetch Kopano licenses")
+	serveCmd.Flags().StringArray("licenses-include", nil, "Glob pattern for license file names to load (can be used multiple times, default legacy names and "+strings.Join(kustomer.DefaultLicenseIncludePatterns, ", ")+")")
+	serveCmd.Flags().StringArray("licenses-exclude", nil, "Glob pattern for license file names to ignore (can be used multiple times, default "+strings.Join(kustomer.DefaultLicenseExcludePatterns, ", ")+")")
+	serveCmd.Flags().Bool("licenses-recursive", false, "Scan sub folders of the licenses path for license files")
+	serveCmd.Flags().String("licenses-issuer", "", "Expected issuer of Kopano licenses (default "+kustomer.DefaultLicenseIssuer+")")
+	serveCmd.Flags().StringArray("licenses-audience", nil, "Accepted audience of Kopano licenses (can be used multiple times, default "+strings.Join(kustomer.DefaultLicenseAudiences, ", ")+")")
+	serveCmd.Flags().StringArray("licenses-algorithm", nil, "Accepted signature algorithm of Kopano licenses (can be used multiple times, default "+joinAlgorithms(kustomer.DefaultLicenseAlgorithms)+", supported "+joinAlgorithms(kustomer.SupportedLicenseAlgorithms)+")")
+	serveCmd.Flags().Int("licenses-min-rsa-key-size", kustomer.DefaultMinRSAKeySize, "Minimal size in bits of RSA keys signing Kopano licenses")
+	serveCmd.Flags().Bool("licenses-jwks-signed", server.DefaultLicenseJWKSSigned == "yes", "Only accept the license JWKS when signed with a certificate chaining to the license root certificates")
+	serveCmd.Flags().Duration("licenses-jwks-hedge-delay", 0, "Delay after which the backup JWKS mirrors are queried in parallel to the primary (0 to query them one after another)")
+	serveCmd.Flags().StringArray("licenses-root-certs", nil, "Path to a PEM file with additional root certificates for offline license validation, licenses validated with them are not trusted (can be used multiple times)")
+	serveCmd.Flags().StringArray("licenses-jwks-uri", nil, "Additional HTTPS or file:// URI of a JWKS for license validation, licenses validated with it are not trusted (can be used multiple times)")
+	serveCmd.Flags().StringArray("licenses-intermediates", nil, "Path to a PEM file with intermediate certificates for offline license validation (can be used multiple times)")
+	serveCmd.Flags().StringArray("licenses-crl", nil, "Path to a PEM or DER certificate revocation list for offline license validation (can be used multiple times)")
+	serveCmd.Flags().StringArray("licenses-cert-eku", nil, "Accepted extended key usage name or OID of certificates signing Kopano licenses (can be used multiple times, default serverAuth, codeSigning)")
+	serveCmd.Flags().StringArray("licenses-cert-policy", nil, "Accepted policy OID of certificates signing Kopano licenses (can be used multiple times)")
+	serveCmd.Flags().Duration("licenses-grace-period", 0, "Duration expired Kopano licenses stay active in grace mode (0 to disable)")
+	serveCmd.Flags().Duration("licenses-key-overlap", 7*24*time.Hour, "Duration keys removed from the license JWKS are still accepted (0 to disable)")
+	serveCmd.Flags().String("licenses-symlinks", string(kustomer.SymlinkPolicyFollow), "Handling of symbolic links in the licenses path (one of follow, ignore or inside)")
+	serveCmd.Flags().StringVar(&hostKeyPath, "host-key", hostKeyPath, "Path to the private host key JWK file to decrypt encrypted Kopano licenses (empty to disable)")
+	serveCmd.Flags().String("revocations-file", "", "Path to a signed license revocation list file (empty to disable)")
 	serveCmd.Flags().StringVar(&listenPath, "listen-path", listenPath, "Path to unix socket for API requests")
+	serveCmd.Flags().StringVar(&statePath, "state-path", statePath, "Path to folder for persistent state (empty to disable)")
+	serveCmd.Flags().Duration("history-retention", server.DefaultHistoryRetention, "Duration entries of the history of effective license claims are kept (0 to keep forever)")
+	serveCmd.Flags().String("audit-log", "", "Path to the audit log file of license lifecycle and API access (empty to disable)")
+	serveCmd.Flags().Int64("audit-log-max-size", server.DefaultAuditLogMaxSize/1024/1024, "Size in MiB at which the audit log is rotated (0 to disable)")
+	serveCmd.Flags().Duration("audit-log-retention", server.DefaultAuditLogRetention, "Duration rotated audit log files are kept (0 to keep forever)")
 	serveCmd.Flags().BoolVar(&defaultInsecure, "insecure", defaultInsecure, "Disable TLS certificate and hostname validation")
-	serveCmd.Flags().BoolVar(&defaultSystemdNotify, "systemd-notify", defaultSystemdNotify, "Enable systemd sd_notify callback")
+	serveCmd.Flags().BoolVar(&defaultSystemdNotify, "systemd-notify", defaultSystemdNotify, "Enable systemd sd_notify callback, status and watchdog notifications")
 
 	return serveCmd
 }
@@ -96,15 +142,166 @@ func serve(cmd *cobra.Command, args []string) error {
 
 	logTimestamp, _ := cmd.Flags().GetBool("log-timestamp")
 	logLevel, _ := cmd.Flags().GetString("log-level")
+	logFormat, _ := cmd.Flags().GetString("log-format")
+	logOutput, _ := cmd.Flags().GetString("log-output")
 
-	logger, err := newLogger(!logTimestamp, logLevel)
+	logger, err := newLogger(!logTimestamp, logLevel, logFormat, logOutput)
 	if err != nil {
 		return fmt.Errorf("failed to create logger: %w", err)
 	}
 
 	logger.Debugln("serve start")
 
+	licenseSources := make([]*kustomer.LicenseSource, 0, len(licensesPaths))
+	for _, licensesPath := range licensesPaths {
+		src, parseErr := kustomer.ParseLicenseSource(licensesPath)
+		if parseErr != nil {
+			return fmt.Errorf("invalid licenses-path value: %w", parseErr)
+		}
+		licenseSources = append(licenseSources, src)
+	}
+	if licensesEnvPrefix != "" {
+		licenseSources = append(licenseSources, &kustomer.LicenseSource{
+			Type: kustomer.LicenseSourceTypeEnv,
+			Path: licensesEnvPrefix,
+		})
+	}
+	licensesFiles, _ := cmd.Flags().GetStringArray("licenses-file")
+	for _, licensesFile := range licensesFiles {
+		src, readErr := func() (*kustomer.LicenseSource, error) {
+			f, openErr := os.Open(licensesFile)
+			if openErr != nil {
+				return nil, openErr
+			}
+			defer f.Close()
+			return kustomer.NewLicenseSourceFromReader("file:"+licensesFile, f)
+		}()
+		if readErr != nil {
+			return fmt.Errorf("failed to read licenses-file: %w", readErr)
+		}
+		licenseSources = append(licenseSources, src)
+	}
+	if licensesStdin, _ := cmd.Flags().GetBool("licenses-stdin"); licensesStdin {
+		src, readErr := kustomer.NewLicenseSourceFromReader("stdin", os.Stdin)
+		if readErr != nil {
+			return fmt.Errorf("failed to read licenses from stdin: %w", readErr)
+		}
+		licenseSources = append(licenseSources, src)
+	}
+	licensesInclude, _ := cmd.Flags().GetStringArray("licenses-include")
+	licensesExclude, _ := cmd.Flags().GetStringArray("licenses-exclude")
+	licensesRecursive, _ := cmd.Flags().GetBool("licenses-recursive")
+	licensesSymlinksString, _ := cmd.Flags().GetString("licenses-symlinks")
+	licensesSymlinks, err := kustomer.ParseSymlinkPolicy(licensesSymlinksString)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range append(licensesInclude, licensesExclude...) {
+		if _, matchErr := filepath.Match(pattern, ""); matchErr != nil {
+			return fmt.Errorf("invalid license file name pattern %v: %w", pattern, matchErr)
+		}
+	}
+
+	strictSub, _ := cmd.Flags().GetBool("strict-sub")
+	if strictSub && globalSub == "" {
+		return fmt.Errorf("strict-sub requires KOPANO_KUSTOMERD_LICENSE_SUB to be set")
+	}
+
+	clusterID, _ := cmd.Flags().GetString("cluster-id")
+	licensesAlgorithmNames, _ := cmd.Flags().GetStringArray("licenses-algorithm")
+	licensesAlgorithms, err := kustomer.ParseLicenseAlgorithms(licensesAlgorithmNames)
+	if err != nil {
+		return err
+	}
+	licensesMinRSAKeySize, _ := cmd.Flags().GetInt("licenses-min-rsa-key-size")
+	if licensesMinRSAKeySize < 2048 {
+		return fmt.Errorf("licenses-min-rsa-key-size must be at least 2048")
+	}
+	var licensesIntermediates []*x509.Certificate
+	licensesIntermediatesFiles, _ := cmd.Flags().GetStringArray("licenses-intermediates")
+	for _, fn := range licensesIntermediatesFiles {
+		certs, loadErr := kustomer.LoadCertificates(fn)
+		if loadErr != nil {
+			return fmt.Errorf("failed to load intermediate certificates: %w", loadErr)
+		}
+		licensesIntermediates = append(licensesIntermediates, certs...)
+	}
+	var licensesCRLs []*pkix.CertificateList
+	licensesCRLFiles, _ := cmd.Flags().GetStringArray("licenses-crl")
+	for _, fn := range licensesCRLFiles {
+		crl, loadErr := kustomer.LoadCRL(fn)
+		if loadErr != nil {
+			return fmt.Errorf("failed to load certificate revocation list: %w", loadErr)
+		}
+		licensesCRLs = append(licensesCRLs, crl)
+	}
+	var licensesCertExtKeyUsages []asn1.ObjectIdentifier
+	licensesCertEKUs, _ := cmd.Flags().GetStringArray("licenses-cert-eku")
+	for _, v := range licensesCertEKUs {
+		oid, parseErr := kustomer.ParseObjectIdentifier(v)
+		if parseErr != nil {
+			return fmt.Errorf("invalid licenses-cert-eku: %w", parseErr)
+		}
+		licensesCertExtKeyUsages = append(licensesCertExtKeyUsages, oid)
+	}
+	var licensesCertPolicies []asn1.ObjectIdentifier
+	licensesCertPolicyStrings, _ := cmd.Flags().GetStringArray("licenses-cert-policy")
+	for _, v := range licensesCertPolicyStrings {
+		oid, parseErr := kustomer.ParseObjectIdentifier(v)
+		if parseErr != nil {
+			return fmt.Errorf("invalid licenses-cert-policy: %w", parseErr)
+		}
+		licensesCertPolicies = append(licensesCertPolicies, oid)
+	}
+
+	var hostKey *jose.JSONWebKey
+	if hostKeyPath != "" {
+		hostKey, err = kustomer.LoadHostKey(hostKeyPath)
+		if err != nil {
+			return err
+		}
+		logger.WithField("kid", hostKey.KeyID).Infoln("loaded host key for encrypted licenses")
+	}
+
+	licensesGracePeriod, _ := cmd.Flags().GetDuration("licenses-grace-period")
+	if licensesGracePeriod < 0 {
+		return fmt.Errorf("licenses-grace-period must not be negative")
+	}
+	licensesKeyOverlap, _ := cmd.Flags().GetDuration("licenses-key-overlap")
+	if licensesKeyOverlap < 0 {
+		return fmt.Errorf("licenses-key-overlap must not be negative")
+	}
+
+	licensesIssuer, _ := cmd.Flags().GetString("licenses-issuer")
+	if licensesIssuer == "" {
+		licensesIssuer = server.DefaultLicenseIssuer
+	}
+	licensesAudiences, _ := cmd.Flags().GetStringArray("licenses-audience")
+	if len(licensesAudiences) == 0 && server.DefaultLicenseAudience != "" {
+		licensesAudiences = strings.Split(server.DefaultLicenseAudience, ",")
+	}
+
+	var licensesFetchURI *url.URL
+	if v, _ := cmd.Flags().GetString("licenses-fetch-uri"); v != "" {
+		licensesFetchURI, err = url.Parse(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse licenses-fetch-uri: %w", err)
+		}
+		if licensesFetchURI.Scheme != "https" && !defaultInsecure {
+			return fmt.Errorf("licenses-fetch-uri must use https unless insecure")
+		}
+	}
+	licensesFetchPath, _ := cmd.Flags().GetString("licenses-fetch-path")
+	licensesFetchInterval, _ := cmd.Flags().GetDuration("licenses-fetch-interval")
+	revocationsFile, _ := cmd.Flags().GetString("revocations-file")
+	historyRetention, _ := cmd.Flags().GetDuration("history-retention")
+	auditLogPath, _ := cmd.Flags().GetString("audit-log")
+	auditLogMaxSize, _ := cmd.Flags().GetInt64("audit-log-max-size")
+	auditLogRetention, _ := cmd.Flags().GetDuration("audit-log-retention")
+
 	trusted := defaultTrusted
+	jwksTrusted := defaultJWKSTrusted
+	certPoolTrusted := true
 
 	certPool := x509.NewCertPool()
 	if server.DefaultLicenseCertsBase64 != "" {
@@ -117,10 +314,12 @@ func serve(cmd *cobra.Command, args []string) error {
 		} else {
 			logger.Warnln("no license root certificates loaded")
 			trusted = false
+			certPoolTrusted = false
 		}
 	} else {
 		logger.Infoln("no license root certificates configured")
 		trusted = false
+		certPoolTrusted = false
 	}
 
 	jwksURIs := make([]*url.URL, 0)
@@ -145,37 +344,156 @@ func serve(cmd *cobra.Command, args []string) error {
 			})
 			jwksURIs = append(jwksURIs, jwksURIsExtra...)
 		}
-		logger.WithField("jwks_uris", jwksURIs).Infoln("JWKS URIs available")
+		logger.WithFields(logrus.Fields{
+			"jwks_uris": jwksURIs,
+			"trusted":   jwksTrusted,
+		}).Infoln("JWKS URIs available")
 	} else {
 		trusted = false
+		jwksTrusted = false
 		logger.Warnln("no JWKS URIs set, this is odd - development build?")
 	}
 
+	jwksSigned, _ := cmd.Flags().GetBool("licenses-jwks-signed")
+	if jwksSigned {
+		if !certPoolTrusted {
+			return fmt.Errorf("licenses-jwks-signed requires license root certificates")
+		}
+		logger.Infoln("license JWKS must be signed")
+	}
+
+	jwksHedgeDelay, _ := cmd.Flags().GetDuration("licenses-jwks-hedge-delay")
+	if jwksHedgeDelay < 0 {
+		return fmt.Errorf("licenses-jwks-hedge-delay must not be negative")
+	}
+
+	var extraCertPool *x509.CertPool
+	licensesRootCertsFiles, _ := cmd.Flags().GetStringArray("licenses-root-certs")
+	for _, fn := range licensesRootCertsFiles {
+		certs, loadErr := kustomer.LoadCertificates(fn)
+		if loadErr != nil {
+			return fmt.Errorf("failed to load root certificates: %w", loadErr)
+		}
+		if extraCertPool == nil {
+			extraCertPool = x509.NewCertPool()
+		}
+		for _, cert := range certs {
+			extraCertPool.AddCert(cert)
+		}
+		logger.WithFields(logrus.Fields{
+			"name":    fn,
+			"count":   len(certs),
+			"trusted": false,
+		}).Infoln("loaded additional root license certificates")
+	}
+	var extraJWKSURIs []*url.URL
+	licensesJWKSURIStrings, _ := cmd.Flags().GetStringArray("licenses-jwks-uri")
+	for _, v := range licensesJWKSURIStrings {
+		jwksURI, parseErr := url.Parse(v)
+		if parseErr != nil {
+			return fmt.Errorf("failed to parse licenses-jwks-uri: %w", parseErr)
+		}
+		switch jwksURI.Scheme {
+		case "https", "file":
+		case "http":
+			if !defaultInsecure {
+				return fmt.Errorf("licenses-jwks-uri must use https or file unless insecure")
+			}
+		default:
+			return fmt.Errorf("licenses-jwks-uri must use https or file")
+		}
+		extraJWKSURIs = append(extraJWKSURIs, jwksURI)
+	}
+	if len(extraJWKSURIs) > 0 {
+		logger.WithFields(logrus.Fields{
+			"jwks_uris": extraJWKSURIs,
+			"trusted":   false,
+		}).Infoln("additional JWKS URIs available")
+	}
+
 	if !trusted {
 		logger.Warnln("customization detected, services might reject license information")
 	}
 
+	listener, err := systemdListener(logger)
+	if err != nil {
+		return err
+	}
+	if listener != nil {
+		logger.WithField("socket", listener.Addr().String()).Infoln("using systemd socket activation listener")
+	}
+
 	cfg := &server.Config{
-		Sub: globalSub,
+		Sub:       globalSub,
+		StrictSub: strictSub,
+		ClusterID: clusterID,
+
+		LicenseSources:    licenseSources,
+		LicensesInclude:   licensesInclude,
+		LicensesExclude:   licensesExclude,
+		LicensesRecursive: licensesRecursive,
+		LicensesSymlinks:  licensesSymlinks,
+		LicensesIssuer:    licensesIssuer,
+		LicensesAudiences: licensesAudiences,
+
+		LicensesGracePeriod: licensesGracePeriod,
+
+		LicensesKeyOverlap: licensesKeyOverlap,
+
+		LicensesAlgorithms:    licensesAlgorithms,
+		LicensesMinRSAKeySize: licensesMinRSAKeySize,
+
+		LicensesIntermediates:    licensesIntermediates,
+		LicensesCertExtKeyUsages: licensesCertExtKeyUsages,
+		LicensesCertPolicies:     licensesCertPolicies,
+		LicensesCRLs:             licensesCRLs,
+
+		HostKey: hostKey,
+
+		LicensesFetchURI:      licensesFetchURI,
+		LicensesFetchPath:     licensesFetchPath,
+		LicensesFetchInterval: licensesFetchInterval,
+
+		RevocationsFile: revocationsFile,
+
+		AuditLogPath:      auditLogPath,
+		AuditLogMaxSize:   auditLogMaxSize * 1024 * 1024,
+		AuditLogRetention: auditLogRetention,
 
-		LicensesPath: licensesPath,
-		ListenPath:   listenPath,
+		ListenPath: listenPath,
+		StatePath:  statePath,
+		Listener:   listener,
+
+		HistoryRetention: historyRetention,
 
 		Insecure: defaultInsecure,
 
-		Trusted:  trusted,
-		JWKSURIs: jwksURIs,
-		CertPool: certPool,
+		Trusted:        trusted,
+		JWKSURIs:       jwksURIs,
+		JWKSSigned:     jwksSigned,
+		JWKSHedgeDelay: jwksHedgeDelay,
+		CertPool:       certPool,
+
+		JWKSTrusted:     jwksTrusted,
+		CertPoolTrusted: certPoolTrusted,
+
+		ExtraJWKSURIs: extraJWKSURIs,
+		ExtraCertPool: extraCertPool,
 
 		Logger: logger,
 
 		OnFirstClaims: func(srv *server.Server) {
-			if defaultSystemdNotify {
-				ok, notifyErr := systemDaemon.SdNotify(false, systemDaemon.SdNotifyReady)
-				logger.WithField("ok", ok).Debugln("called systemd sd_notify ready")
-				if notifyErr != nil {
-					logger.WithError(notifyErr).Errorln("failed to trigger systemd sd_notify")
-				}
+			sdNotify(logger, systemDaemon.SdNotifyReady)
+			startSystemdWatchdog(logger, srv)
+		},
+		OnStatus: func(srv *server.Server, status string) {
+			sdNotify(logger, "STATUS="+status)
+		},
+		OnReload: func(srv *server.Server, done bool) {
+			if done {
+				sdNotify(logger, systemDaemon.SdNotifyReady)
+			} else {
+				sdNotify(logger, systemDaemon.SdNotifyReloading)
 			}
 		},
 	}
@@ -187,3 +505,11 @@ func serve(cmd *cobra.Command, args []string) error {
 
 	return srv.Serve(ctx)
 }
+
+func joinAlgorithms(algorithms []jose.SignatureAlgorithm) string {
+	names := make([]string, 0, len(algorithms))
+	for _, alg := range algorithms {
+		names = append(names, string(alg))
+	}
+	return strings.Join(names, ", ")
+}
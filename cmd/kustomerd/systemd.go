@@ -0,0 +1,111 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	systemDaemon "github.com/coreos/go-systemd/v22/daemon"
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kgol/kustomer/server"
+)
+
+// sdNotify sends the provided state to systemd if systemd notify is enabled.
+func sdNotify(logger logrus.FieldLogger, state string) {
+	if !defaultSystemdNotify {
+		return
+	}
+	ok, err := systemDaemon.SdNotify(false, state)
+	logger.WithFields(logrus.Fields{
+		"ok":    ok,
+		"state": state,
+	}).Debugln("called systemd sd_notify")
+	if err != nil {
+		logger.WithError(err).Errorln("failed to trigger systemd sd_notify")
+	}
+}
+
+// startSystemdWatchdog sends watchdog keep-alive notifications to systemd
+// while the provided server is live, if the systemd watchdog is enabled.
+func startSystemdWatchdog(logger logrus.FieldLogger, srv *server.Server) {
+	if !defaultSystemdNotify {
+		return
+	}
+	interval, err := systemDaemon.SdWatchdogEnabled(false)
+	if err != nil {
+		logger.WithError(err).Errorln("failed to check systemd watchdog")
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	logger.WithField("interval", interval).Debugln("systemd watchdog enabled")
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if health := srv.Health(); !health.Live {
+				// Let systemd restart the service when the license scan is stuck.
+				logger.WithField("heartbeat", health.Heartbeat).Warnln("license scan heartbeat is stale, skipping systemd watchdog notification")
+				continue
+			}
+			if _, notifyErr := systemDaemon.SdNotify(false, systemDaemon.SdNotifyWatchdog); notifyErr != nil {
+				logger.WithError(notifyErr).Errorln("failed to trigger systemd watchdog")
+			}
+		}
+	}()
+}
+
+// systemdListenerName is the file descriptor name of the API listener passed
+// with systemd socket activation, as set by FileDescriptorName in the socket
+// unit.
+const systemdListenerName = "api"
+
+// systemdListener returns the API listener passed with systemd socket
+// activation, or nil if there is none. Listeners are selected by name from
+// LISTEN_FDNAMES, falling back to a single unnamed listener.
+func systemdListener(logger logrus.FieldLogger) (net.Listener, error) {
+	named, err := activation.ListenersWithNames()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get systemd socket activation listeners: %w", err)
+	}
+	return selectSystemdListener(named, logger)
+}
+
+// selectSystemdListener returns the API listener from the provided systemd
+// socket activation listeners by name, or nil if there is none.
+func selectSystemdListener(named map[string][]net.Listener, logger logrus.FieldLogger) (net.Listener, error) {
+	if len(named) == 0 {
+		return nil, nil
+	}
+
+	listeners, ok := named[systemdListenerName]
+	if !ok {
+		var names []string
+		for name := range named {
+			names = append(names, name)
+		}
+		if len(names) > 1 {
+			sort.Strings(names)
+			return nil, fmt.Errorf("no systemd socket activation listener named %s, got %v", systemdListenerName, names)
+		}
+		// A single socket unit without FileDescriptorName passes its unit name.
+		listeners = named[names[0]]
+	}
+	if len(listeners) == 0 {
+		return nil, nil
+	}
+	if len(listeners) > 1 {
+		logger.WithField("count", len(listeners)).Warnln("multiple systemd socket activation listeners, using the first")
+	}
+	return listeners[0], nil
+}
@@ -0,0 +1,86 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type testListener struct {
+	name string
+}
+
+func (l *testListener) Accept() (net.Conn, error) { return nil, nil }
+func (l *testListener) Close() error              { return nil }
+func (l *testListener) Addr() net.Addr            { return nil }
+
+func TestSelectSystemdListener(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	api := &testListener{"api"}
+	other := &testListener{"other"}
+	unnamed := &testListener{"unnamed"}
+
+	for _, tc := range []struct {
+		name     string
+		named    map[string][]net.Listener
+		expected *testListener
+		err      bool
+	}{
+		{"none", nil, nil, false},
+		{"named api", map[string][]net.Listener{
+			"api": {api},
+		}, api, false},
+		{"named api with others", map[string][]net.Listener{
+			"metrics": {other},
+			"api":     {api},
+		}, api, false},
+		{"multiple api uses first", map[string][]net.Listener{
+			"api": {api, other},
+		}, api, false},
+		{"single unnamed", map[string][]net.Listener{
+			"LISTEN_FD_3": {unnamed},
+		}, unnamed, false},
+		{"single other name", map[string][]net.Listener{
+			"kopano-kustomerd.socket": {unnamed},
+		}, unnamed, false},
+		{"multiple unnamed", map[string][]net.Listener{
+			"LISTEN_FD_3": {unnamed},
+			"LISTEN_FD_4": {other},
+		}, nil, true},
+		{"multiple other names", map[string][]net.Listener{
+			"metrics": {other},
+			"admin":   {unnamed},
+		}, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := selectSystemdListener(tc.named, logger)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got listener %v", listener)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expected == nil {
+				if listener != nil {
+					t.Errorf("expected no listener, got %v", listener)
+				}
+				return
+			}
+			if listener != tc.expected {
+				t.Errorf("expected listener %s, got %v", tc.expected.name, listener)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A LicensesFetcher defines the parameters how to fetch the current licenses
+// of a customer from URI.
+type LicensesFetcher struct {
+	URI       *url.URL
+	UserAgent string
+
+	Client *http.Client
+	Logger logrus.FieldLogger
+
+	sub  string
+	etag string
+}
+
+// Fetch fetches the current licenses for the provided sub from the associated
+// URI. It returns nil data if nothing has changed since the last fetch and
+// empty data if there are no licenses for the provided sub.
+func (lf *LicensesFetcher) Fetch(ctx context.Context, sub string) ([]byte, error) {
+	if sub != lf.sub {
+		lf.sub = sub
+		lf.etag = ""
+	}
+
+	uri := *lf.URI
+	query := uri.Query()
+	query.Set("sub", sub)
+	uri.RawQuery = query.Encode()
+
+	requestCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	request, requestErr := http.NewRequestWithContext(requestCtx, http.MethodGet, uri.String(), nil)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	request.Header.Set("Accept", "application/jwt")
+	if lf.UserAgent != "" {
+		request.Header.Set("User-Agent", lf.UserAgent)
+	}
+	if lf.etag != "" {
+		request.Header.Set("If-None-Match", lf.etag)
+	}
+
+	response, responseErr := lf.Client.Do(request)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		// Nothing changed. Done for now.
+		return nil, nil
+	case http.StatusNotFound:
+		// No licenses for sub.
+		lf.etag = ""
+		return []byte{}, nil
+	case http.StatusOK:
+		data, readErr := ioutil.ReadAll(io.LimitReader(response.Body, licenseSizeLimitBytes))
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read licenses from %s: %w", lf.URI, readErr)
+		}
+		lf.etag = response.Header.Get("ETag")
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unexpected response status %d when fetching licenses from %s", response.StatusCode, lf.URI)
+	}
+}
+
+// Reset resets the associated fetcher, so the next fetch does not depend on
+// any previous fetch.
+func (lf *LicensesFetcher) Reset() {
+	lf.etag = ""
+}
+
+// ETag returns the ETag of the last successful fetch.
+func (lf *LicensesFetcher) ETag() string {
+	return lf.etag
+}
@@ -0,0 +1,197 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A SymlinkPolicy defines how symbolic links are handled when scanning for
+// license files.
+type SymlinkPolicy string
+
+// Supported symbolic link policies.
+const (
+	SymlinkPolicyFollow SymlinkPolicy = "follow"
+	SymlinkPolicyIgnore SymlinkPolicy = "ignore"
+	SymlinkPolicyInside SymlinkPolicy = "inside"
+)
+
+// ParseSymlinkPolicy returns the SymlinkPolicy matching the provided value.
+func ParseSymlinkPolicy(value string) (SymlinkPolicy, error) {
+	switch policy := SymlinkPolicy(value); policy {
+	case SymlinkPolicyFollow, SymlinkPolicyIgnore, SymlinkPolicyInside:
+		return policy, nil
+	case "":
+		return SymlinkPolicyFollow, nil
+	default:
+		return "", fmt.Errorf("unknown symlink policy: %v", value)
+	}
+}
+
+var (
+	// DefaultLicenseIncludePatterns are the glob patterns used for license
+	// file names, when no include patterns are set. In addition file names
+	// without extension are included as that is what legacy installations use.
+	DefaultLicenseIncludePatterns = []string{"*.license", "*.jwt", "*.lic"}
+
+	// DefaultLicenseExcludePatterns are the glob patterns used for file names
+	// which are never license files, when no exclude patterns are set.
+	DefaultLicenseExcludePatterns = []string{"README*"}
+)
+
+// licenseBackupPatterns match editor and package manager backup files. Those
+// are always ignored, same as hidden files.
+var licenseBackupPatterns = []string{
+	"*~",
+	"#*#",
+	"*.bak",
+	"*.old",
+	"*.orig",
+	"*.rej",
+	"*.swp",
+	"*.tmp",
+	"*.dpkg-*",
+	"*.rpmnew",
+	"*.rpmorig",
+	"*.rpmsave",
+	"*.ucf-*",
+}
+
+// findLicenseFiles returns the names of all files in licensesPath which match
+// the file rules of the associated loader.
+func (ll *LicensesLoader) findLicenseFiles(logger logrus.FieldLogger, licensesPath string) ([]string, error) {
+	root, err := filepath.EvalSymlinks(licensesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0)
+	visited := make(map[string]bool)
+
+	var walk func(string) error
+	walk = func(dir string) error {
+		files, readDirErr := ioutil.ReadDir(dir)
+		if readDirErr != nil {
+			return readDirErr
+		}
+		for _, info := range files {
+			name := info.Name()
+			if isHiddenOrBackupFileName(name) {
+				continue
+			}
+			fn := filepath.Join(dir, name)
+			if info.Mode()&os.ModeSymlink != 0 {
+				if ll.Symlinks == SymlinkPolicyIgnore {
+					continue
+				}
+				target, evalErr := filepath.EvalSymlinks(fn)
+				if evalErr == nil && ll.Symlinks == SymlinkPolicyInside && !isInsidePath(root, target) {
+					evalErr = fmt.Errorf("target %s is outside of %s", target, licensesPath)
+				}
+				if evalErr == nil {
+					info, evalErr = os.Stat(target)
+				}
+				if evalErr != nil {
+					if _, ok := ll.LoadHistory[fn]; !ok {
+						logger.WithError(evalErr).WithField("name", fn).Warnln("license folder symlink ignored")
+						if ll.LoadHistory != nil {
+							ll.LoadHistory[fn] = nil
+						}
+					}
+					continue
+				}
+			}
+			if info.IsDir() {
+				if !ll.Recursive {
+					continue
+				}
+				realPath, evalErr := filepath.EvalSymlinks(fn)
+				if evalErr != nil || visited[realPath] {
+					continue
+				}
+				visited[realPath] = true
+				if walkErr := walk(fn); walkErr != nil {
+					logger.WithError(walkErr).WithField("name", fn).Errorln("failed to read license sub folder")
+				}
+				continue
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			rel, _ := filepath.Rel(licensesPath, fn)
+			if !ll.matchLicenseFileName(rel) {
+				continue
+			}
+			result = append(result, fn)
+		}
+		return nil
+	}
+	visited[root] = true
+
+	return result, walk(licensesPath)
+}
+
+// matchLicenseFileName returns true if the provided file name, relative to the
+// licenses folder, matches the include and exclude patterns of the associated
+// loader.
+func (ll *LicensesLoader) matchLicenseFileName(rel string) bool {
+	exclude := ll.Exclude
+	if len(exclude) == 0 {
+		exclude = DefaultLicenseExcludePatterns
+	}
+	if matchAnyPattern(exclude, rel) {
+		return false
+	}
+
+	include := ll.Include
+	if len(include) == 0 {
+		if filepath.Ext(rel) == "" {
+			// Legacy license file name.
+			return true
+		}
+		include = DefaultLicenseIncludePatterns
+	}
+	return matchAnyPattern(include, rel)
+}
+
+// matchAnyPattern returns true if any of the provided glob patterns matches
+// the provided relative file name. Patterns without path separator are matched
+// against the base name only.
+func matchAnyPattern(patterns []string, rel string) bool {
+	base := filepath.Base(rel)
+	for _, pattern := range patterns {
+		name := base
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			name = rel
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isHiddenOrBackupFileName(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	return matchAnyPattern(licenseBackupPatterns, name)
+}
+
+func isInsidePath(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
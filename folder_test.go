@@ -0,0 +1,81 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestFindLicenseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kustomer-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"a.license",
+		"b.jwt",
+		"legacy",
+		"README",
+		"notes.md",
+		".hidden.license",
+		"c.license~",
+		"d.license.dpkg-old",
+		"groupware/e.license",
+		"groupware/f.bak",
+	} {
+		fn := filepath.Join(dir, name)
+		if mkdirErr := os.MkdirAll(filepath.Dir(fn), 0700); mkdirErr != nil {
+			t.Fatal(mkdirErr)
+		}
+		if writeErr := ioutil.WriteFile(fn, nil, 0600); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	for _, tc := range []struct {
+		name     string
+		loader   *LicensesLoader
+		expected []string
+	}{
+		{"defaults", &LicensesLoader{}, []string{"a.license", "b.jwt", "legacy"}},
+		{"recursive", &LicensesLoader{Recursive: true}, []string{"a.license", "b.jwt", "groupware/e.license", "legacy"}},
+		{"include", &LicensesLoader{Include: []string{"*.license"}, Recursive: true}, []string{"a.license", "groupware/e.license"}},
+		{"exclude", &LicensesLoader{Exclude: []string{"groupware/*", "legacy"}, Recursive: true}, []string{"README", "a.license", "b.jwt"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files, findErr := tc.loader.findLicenseFiles(logger, dir)
+			if findErr != nil {
+				t.Fatal(findErr)
+			}
+			result := make([]string, 0, len(files))
+			for _, fn := range files {
+				rel, _ := filepath.Rel(dir, fn)
+				result = append(result, rel)
+			}
+			sort.Strings(result)
+			if len(result) != len(tc.expected) {
+				t.Fatalf("unexpected files: %v", result)
+			}
+			for idx, rel := range result {
+				if rel != tc.expected[idx] {
+					t.Errorf("unexpected files: %v", result)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// LicenseKeyAlgorithms are the key management algorithms accepted for
+// encrypted licenses.
+var LicenseKeyAlgorithms = []jose.KeyAlgorithm{
+	jose.ECDH_ES,
+	jose.ECDH_ES_A128KW,
+	jose.ECDH_ES_A192KW,
+	jose.ECDH_ES_A256KW,
+}
+
+// GenerateHostKey generates a new private host key to decrypt encrypted
+// licenses.
+func GenerateHostKey() (*jose.JSONWebKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate host key: %w", err)
+	}
+
+	key := &jose.JSONWebKey{
+		Key:       privateKey,
+		Algorithm: string(jose.ECDH_ES),
+		Use:       "enc",
+	}
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host key thumbprint: %w", err)
+	}
+	key.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	return key, nil
+}
+
+// LoadHostKey loads the private host key from the JWK file with the provided
+// name.
+func LoadHostKey(fn string) (*jose.JSONWebKey, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+
+	key := &jose.JSONWebKey{}
+	if err = json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("failed to parse host key: %w", err)
+	}
+	if _, ok := key.Key.(*ecdsa.PrivateKey); !ok {
+		return nil, errors.New("host key is not an EC private key")
+	}
+
+	return key, nil
+}
+
+func containsKeyAlgorithm(algorithms []jose.KeyAlgorithm, alg jose.KeyAlgorithm) bool {
+	for _, v := range algorithms {
+		if v == alg {
+			return true
+		}
+	}
+	return false
+}
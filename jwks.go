@@ -6,17 +6,36 @@
 package kustomer
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/square/go-jose.v2"
 )
 
+const (
+	jwksSizeLimitBytes  = 1024 * 1024
+	jwksUpdateQueueSize = 16
+
+	// DefaultJWKSRefreshInterval is the interval in which a started
+	// JWKSFetcher refreshes its JWKS if no Interval is set.
+	DefaultJWKSRefreshInterval = 60 * time.Minute
+)
+
+// SignedJWKSContentType is the required cty header value of signed JWKS
+// documents.
+const SignedJWKSContentType = "jwk-set+json"
+
 // A JWKSFetcher defines the parameters how to fetch a JWK set from URI.
 type JWKSFetcher struct {
 	URIs      []*url.URL
@@ -27,74 +46,168 @@ type JWKSFetcher struct {
 
 	MaxRetries int
 
+	// Decode, if set, is used to decode and validate fetched JWKS documents
+	// instead of plain JSON decoding. Documents which fail to decode are
+	// rejected and the next URI is tried.
+	Decode func(data []byte) (*jose.JSONWebKeySet, error)
+
+	// HedgeDelay enables racing of URIs if greater than zero. The first URI
+	// is queried first and after HedgeDelay, or as soon as the first URI
+	// failed, all other URIs are queried in parallel.
+	HedgeDelay time.Duration
+
+	// Interval is the refresh interval after Start.
+	Interval time.Duration
+
 	jwks    *jose.JSONWebKeySet
 	etag    string
 	offline bool
+
+	mutex       sync.RWMutex
+	updateMutex sync.Mutex
+	stats       map[string]*JWKSMirrorStats
+	subscribers map[chan *JWKSUpdate]struct{}
+}
+
+// A JWKSUpdate is sent to the subscribers of a JWKSFetcher after each update
+// of its refresh loop.
+type JWKSUpdate struct {
+	// Changed is true if a JWKS was fetched, see JWKS() for the current one.
+	Changed bool
+	Offline bool
+	Err     error
+}
+
+// JWKSMirrorStats are the health statistics of a JWKS URI.
+type JWKSMirrorStats struct {
+	URI string `json:"uri"`
+
+	Requests  uint64 `json:"requests"`
+	Successes uint64 `json:"successes"`
+	Failures  uint64 `json:"failures"`
+	Cancelled uint64 `json:"cancelled"`
+
+	LastLatency time.Duration `json:"last_latency"`
+	LastSuccess time.Time     `json:"last_success"`
+	LastError   string        `json:"last_error,omitempty"`
+}
+
+// Start starts the refresh loop of the associated fetcher in the background.
+// The JWKS is updated immediately and then every Interval until the provided
+// context is done. Subscribers are notified after each update. Start must
+// only be called once.
+func (jwksf *JWKSFetcher) Start(ctx context.Context) {
+	interval := jwksf.Interval
+	if interval <= 0 {
+		interval = DefaultJWKSRefreshInterval
+	}
+
+	go func() {
+		for {
+			jwks, err := jwksf.Update(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			jwksf.notify(&JWKSUpdate{
+				Changed: jwks != nil,
+				Offline: jwksf.Offline(),
+				Err:     err,
+			})
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+				// Refresh.
+			}
+		}
+	}()
+}
+
+// Subscribe registers a new update channel with the associated fetcher. The
+// returned channel receives all updates until Unsubscribe is called with it.
+func (jwksf *JWKSFetcher) Subscribe() <-chan *JWKSUpdate {
+	ch := make(chan *JWKSUpdate, jwksUpdateQueueSize)
+
+	jwksf.mutex.Lock()
+	if jwksf.subscribers == nil {
+		jwksf.subscribers = make(map[chan *JWKSUpdate]struct{})
+	}
+	jwksf.subscribers[ch] = struct{}{}
+	jwksf.mutex.Unlock()
+
+	return ch
+}
+
+// Unsubscribe removes the provided update channel from the associated
+// fetcher.
+func (jwksf *JWKSFetcher) Unsubscribe(ch <-chan *JWKSUpdate) {
+	jwksf.mutex.Lock()
+	defer jwksf.mutex.Unlock()
+	for subscriber := range jwksf.subscribers {
+		if subscriber == ch {
+			delete(jwksf.subscribers, subscriber)
+			break
+		}
+	}
+}
+
+// notify sends the provided update to all subscribed update channels. Updates
+// are dropped for channels which are full.
+func (jwksf *JWKSFetcher) notify(update *JWKSUpdate) {
+	jwksf.mutex.RLock()
+	defer jwksf.mutex.RUnlock()
+	for ch := range jwksf.subscribers {
+		select {
+		case ch <- update:
+		default:
+			if jwksf.Logger != nil {
+				jwksf.Logger.Debugln("JWKS update queue full, update dropped")
+			}
+		}
+	}
 }
 
-// Update fetches the JWKS from its URI with retry.
+// Update fetches the JWKS from its URI with retry. If HedgeDelay is set, all
+// URIs are raced in each attempt. Concurrent calls are serialized.
 func (jwksf *JWKSFetcher) Update(ctx context.Context) (*jose.JSONWebKeySet, error) {
 	logger := jwksf.Logger
 	if logger == nil {
 		logger = logrus.StandardLogger()
 	}
 
+	jwksf.updateMutex.Lock()
+	defer jwksf.updateMutex.Unlock()
+
 	var attempt int = 1
 	var uriIndex int
 	for {
-		uriIndex = attempt - 1
-		if uriIndex >= len(jwksf.URIs) {
-			uriIndex = 0
-		}
-		jwks, etag, err := func(uri *url.URL, userAgent string, etag string) (*jose.JSONWebKeySet, string, error) {
-			requestCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-			defer cancel()
-
-			request, requestErr := http.NewRequestWithContext(requestCtx, http.MethodGet, uri.String(), nil)
-			if requestErr != nil {
-				return nil, "", requestErr
-			}
-			if userAgent != "" {
-				request.Header.Set("User-Agent", userAgent)
-			}
-			if etag != "" {
-				request.Header.Set("If-None-Match", etag)
-			}
-
-			response, responseErr := jwksf.Client.Do(request)
-			if responseErr != nil {
-				return nil, "", responseErr
-			}
-
-			switch response.StatusCode {
-			case http.StatusNotModified:
-				// Nothing changed. Done for now.
-				return nil, etag, nil
-			case http.StatusOK:
-				etag = response.Header.Get("ETag")
-				decoder := json.NewDecoder(response.Body)
-				jwks := &jose.JSONWebKeySet{}
-				decodeErr := decoder.Decode(jwks)
-				response.Body.Close()
-				if decodeErr == nil {
-					return jwks, etag, nil
-				} else {
-					return nil, etag, fmt.Errorf("failed to parse JWKS from %s: %w", jwksf.URIs[uriIndex], decodeErr)
-				}
-			default:
-				return nil, etag, fmt.Errorf("unexpected response status %d when fetching JWKS from %s", response.StatusCode, jwksf.URIs[uriIndex])
+		var jwks *jose.JSONWebKeySet
+		var etag string
+		var err error
+		currentETag := jwksf.ETag()
+		if jwksf.HedgeDelay > 0 && len(jwksf.URIs) > 1 {
+			jwks, etag, err = jwksf.race(ctx, currentETag)
+		} else {
+			uriIndex = attempt - 1
+			if uriIndex >= len(jwksf.URIs) {
+				uriIndex = 0
 			}
-		}(jwksf.URIs[uriIndex], jwksf.UserAgent, jwksf.etag)
+			jwks, etag, err = jwksf.fetch(ctx, jwksf.URIs[uriIndex], currentETag)
+		}
 		if err == nil {
+			jwksf.mutex.Lock()
 			jwksf.offline = false
 			if jwks != nil {
 				jwksf.jwks = jwks
 				jwksf.etag = etag
 			}
+			jwksf.mutex.Unlock()
 			return jwks, nil
 		}
 
+		jwksf.mutex.Lock()
 		jwksf.offline = true
+		jwksf.mutex.Unlock()
 		if attempt >= jwksf.MaxRetries {
 			logger.WithError(err).Errorln("failed to fetch JWKS from URI")
 			return nil, err
@@ -109,14 +222,256 @@ func (jwksf *JWKSFetcher) Update(ctx context.Context) (*jose.JSONWebKeySet, erro
 	}
 }
 
+// race fetches the JWKS from the first URI and after HedgeDelay or when the
+// first URI failed, from all other URIs in parallel. The first valid response
+// is returned, all other requests are cancelled.
+func (jwksf *JWKSFetcher) race(ctx context.Context, etag string) (*jose.JSONWebKeySet, string, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		jwks *jose.JSONWebKeySet
+		etag string
+		err  error
+	}
+	resultCh := make(chan *result, len(jwksf.URIs))
+	hedgeCh := make(chan struct{})
+
+	for idx, uri := range jwksf.URIs {
+		go func(idx int, uri *url.URL) {
+			if idx > 0 {
+				select {
+				case <-raceCtx.Done():
+					resultCh <- &result{err: raceCtx.Err()}
+					return
+				case <-hedgeCh:
+				case <-time.After(jwksf.HedgeDelay):
+				}
+			}
+			jwks, etag, err := jwksf.fetch(raceCtx, uri, etag)
+			if idx == 0 && err != nil {
+				// Primary failed, no need to wait for the hedge delay.
+				close(hedgeCh)
+			}
+			resultCh <- &result{jwks, etag, err}
+		}(idx, uri)
+	}
+
+	var err error
+	for range jwksf.URIs {
+		r := <-resultCh
+		if r.err == nil {
+			return r.jwks, r.etag, nil
+		}
+		if err == nil || !errors.Is(r.err, context.Canceled) {
+			err = r.err
+		}
+	}
+	return nil, etag, err
+}
+
+// fetch fetches the JWKS from the provided URI and records the result in the
+// statistics of the URI.
+func (jwksf *JWKSFetcher) fetch(ctx context.Context, uri *url.URL, etag string) (*jose.JSONWebKeySet, string, error) {
+	started := time.Now()
+	jwks, etag, err := func() (*jose.JSONWebKeySet, string, error) {
+		if uri.Scheme == "file" {
+			return jwksf.readJWKSFile(uri.Path, etag)
+		}
+
+		requestCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		request, requestErr := http.NewRequestWithContext(requestCtx, http.MethodGet, uri.String(), nil)
+		if requestErr != nil {
+			return nil, "", requestErr
+		}
+		if jwksf.UserAgent != "" {
+			request.Header.Set("User-Agent", jwksf.UserAgent)
+		}
+		if etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+
+		response, responseErr := jwksf.Client.Do(request)
+		if responseErr != nil {
+			return nil, "", responseErr
+		}
+		defer response.Body.Close()
+
+		switch response.StatusCode {
+		case http.StatusNotModified:
+			// Nothing changed. Done for now.
+			return nil, etag, nil
+		case http.StatusOK:
+			data, readErr := ioutil.ReadAll(io.LimitReader(response.Body, jwksSizeLimitBytes))
+			if readErr != nil {
+				return nil, etag, fmt.Errorf("failed to read JWKS from %s: %w", uri, readErr)
+			}
+			jwks, decodeErr := jwksf.decode(data)
+			if decodeErr == nil {
+				return jwks, response.Header.Get("ETag"), nil
+			} else {
+				return nil, etag, fmt.Errorf("failed to parse JWKS from %s: %w", uri, decodeErr)
+			}
+		default:
+			return nil, etag, fmt.Errorf("unexpected response status %d when fetching JWKS from %s", response.StatusCode, uri)
+		}
+	}()
+	latency := time.Since(started)
+
+	jwksf.mutex.Lock()
+	if jwksf.stats == nil {
+		jwksf.stats = make(map[string]*JWKSMirrorStats)
+	}
+	stats, ok := jwksf.stats[uri.String()]
+	if !ok {
+		stats = &JWKSMirrorStats{
+			URI: uri.String(),
+		}
+		jwksf.stats[uri.String()] = stats
+	}
+	stats.Requests++
+	switch {
+	case err == nil:
+		stats.Successes++
+		stats.LastLatency = latency
+		stats.LastSuccess = time.Now()
+	case ctx.Err() != nil:
+		// Cancelled, not the fault of the URI.
+		stats.Cancelled++
+	default:
+		stats.Failures++
+		stats.LastLatency = latency
+		stats.LastError = err.Error()
+	}
+	jwksf.mutex.Unlock()
+
+	return jwks, etag, err
+}
+
+// Stats returns the health statistics of the URIs of the associated fetcher,
+// in the order of its URIs. URIs which were not used yet are included with
+// zero values.
+func (jwksf *JWKSFetcher) Stats() []JWKSMirrorStats {
+	jwksf.mutex.RLock()
+	defer jwksf.mutex.RUnlock()
+
+	result := make([]JWKSMirrorStats, 0, len(jwksf.URIs))
+	for _, uri := range jwksf.URIs {
+		if stats, ok := jwksf.stats[uri.String()]; ok {
+			result = append(result, *stats)
+		} else {
+			result = append(result, JWKSMirrorStats{
+				URI: uri.String(),
+			})
+		}
+	}
+	return result
+}
+
+// decode decodes the provided JWKS document.
+func (jwksf *JWKSFetcher) decode(data []byte) (*jose.JSONWebKeySet, error) {
+	if jwksf.Decode != nil {
+		return jwksf.Decode(data)
+	}
+	jwks := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(data, jwks); err != nil {
+		return nil, err
+	}
+	return jwks, nil
+}
+
+// readJWKSFile reads the JWKS from the file with the provided name. The etag
+// is derived from the file's modification time and size, nil is returned if it
+// matches the provided etag.
+func (jwksf *JWKSFetcher) readJWKSFile(fn string, etag string) (*jose.JSONWebKeySet, string, error) {
+	info, err := os.Stat(fn)
+	if err != nil {
+		return nil, etag, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	fileETag := fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+	if fileETag == etag {
+		// Nothing changed.
+		return nil, etag, nil
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, etag, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	jwks, err := jwksf.decode(data)
+	if err != nil {
+		return nil, etag, fmt.Errorf("failed to parse JWKS from %s: %w", fn, err)
+	}
+	return jwks, fileETag, nil
+}
+
+// LoadSignedJWKS parses and validates the provided JWS in compact serialization
+// containing a JWKS. The JWS must be signed by the key of its x5c certificate
+// chain, which must validate with CertPool of the associated loader at the
+// provided time. Keys of JWKS and ExtraCertPool are not used.
+func (ll *LicensesLoader) LoadSignedJWKS(data []byte, now time.Time) (*jose.JSONWebKeySet, error) {
+	signed := bytes.TrimSpace(data)
+	object, err := jose.ParseSigned(string(signed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signed JWKS: %w", err)
+	}
+	if len(object.Signatures) != 1 {
+		return nil, errors.New("signed JWKS with multiple signatures")
+	}
+	headers := object.Signatures[0].Protected
+	if cty, _ := headers.ExtraHeaders[jose.HeaderContentType].(string); cty != SignedJWKSContentType {
+		return nil, fmt.Errorf("signed JWKS with unexpected cty: %v", cty)
+	}
+	algorithms := ll.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = DefaultLicenseAlgorithms
+	}
+	if !containsAlgorithm(algorithms, jose.SignatureAlgorithm(headers.Algorithm)) {
+		return nil, errUnknownAlgorithm
+	}
+
+	certs, err := certificateChain(signed)
+	if err != nil {
+		return nil, fmt.Errorf("signed JWKS certificate error: %w", err)
+	}
+	leaf, err := ll.verifyCertificateChain(certs, ll.CertPool, now)
+	if err != nil {
+		return nil, fmt.Errorf("signed JWKS certificate check failed: %w", err)
+	}
+	if err = ll.checkKeySize(leaf.PublicKey); err != nil {
+		return nil, err
+	}
+	payload, err := object.Verify(leaf.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate signed JWKS: %w", err)
+	}
+
+	jwks := &jose.JSONWebKeySet{}
+	if err = json.Unmarshal(payload, jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse signed JWKS payload: %w", err)
+	}
+	if len(jwks.Keys) == 0 {
+		return nil, errors.New("signed JWKS without keys")
+	}
+	return jwks, nil
+}
+
 func (jwksf *JWKSFetcher) Offline() bool {
+	jwksf.mutex.RLock()
+	defer jwksf.mutex.RUnlock()
 	return jwksf.offline
 }
 
 func (jwksf *JWKSFetcher) JWKS() *jose.JSONWebKeySet {
+	jwksf.mutex.RLock()
+	defer jwksf.mutex.RUnlock()
 	return jwksf.jwks
 }
 
 func (jwksf *JWKSFetcher) ETag() string {
+	jwksf.mutex.RLock()
+	defer jwksf.mutex.RUnlock()
 	return jwksf.etag
 }
@@ -0,0 +1,134 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestJWKSServer(t *testing.T, status int, delay time.Duration) (*httptest.Server, *url.URL) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+		rw.WriteHeader(status)
+		_, _ = rw.Write([]byte(`{"keys":[]}`))
+	}))
+	uri, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, uri
+}
+
+func TestJWKSFetcherRace(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	for _, tc := range []struct {
+		name          string
+		primaryStatus int
+		primaryDelay  time.Duration
+		maxDuration   time.Duration
+		stats         []JWKSMirrorStats
+	}{
+		{"primary", http.StatusOK, 0, time.Second, []JWKSMirrorStats{
+			{Requests: 1, Successes: 1},
+			{},
+		}},
+		{"primary slow", http.StatusOK, 5 * time.Second, time.Second, []JWKSMirrorStats{
+			{Requests: 1, Cancelled: 1},
+			{Requests: 1, Successes: 1},
+		}},
+		{"primary failed", http.StatusInternalServerError, 0, 200 * time.Millisecond, []JWKSMirrorStats{
+			{Requests: 1, Failures: 1},
+			{Requests: 1, Successes: 1},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primary, primaryURI := newTestJWKSServer(t, tc.primaryStatus, tc.primaryDelay)
+			defer primary.Close()
+			backup, backupURI := newTestJWKSServer(t, http.StatusOK, 0)
+			defer backup.Close()
+			fetcher := &JWKSFetcher{
+				URIs:       []*url.URL{primaryURI, backupURI},
+				Client:     primary.Client(),
+				Logger:     logger,
+				MaxRetries: 1,
+				HedgeDelay: 500 * time.Millisecond,
+			}
+
+			started := time.Now()
+			jwks, err := fetcher.Update(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if jwks == nil {
+				t.Fatal("expected JWKS")
+			}
+			if duration := time.Since(started); duration > tc.maxDuration {
+				t.Errorf("update took too long: %v", duration)
+			}
+
+			// Wait for cancelled requests to be recorded.
+			time.Sleep(100 * time.Millisecond)
+			for idx, stats := range fetcher.Stats() {
+				expected := tc.stats[idx]
+				if stats.Requests != expected.Requests || stats.Successes != expected.Successes || stats.Failures != expected.Failures || stats.Cancelled != expected.Cancelled {
+					t.Errorf("unexpected stats for mirror %d: %+v", idx, stats)
+				}
+			}
+		})
+	}
+}
+
+func TestJWKSFetcherStart(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	srv, uri := newTestJWKSServer(t, http.StatusOK, 0)
+	defer srv.Close()
+	fetcher := &JWKSFetcher{
+		URIs:       []*url.URL{uri},
+		Client:     srv.Client(),
+		Logger:     logger,
+		MaxRetries: 1,
+		Interval:   10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := fetcher.Subscribe()
+	defer fetcher.Unsubscribe(updates)
+	fetcher.Start(ctx)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case update := <-updates:
+			if update.Err != nil || update.Offline {
+				t.Fatalf("unexpected update: %+v", update)
+			}
+			if !update.Changed {
+				t.Errorf("expected update to have changed")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+		if fetcher.JWKS() == nil {
+			t.Errorf("expected JWKS")
+		}
+	}
+}
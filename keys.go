@@ -0,0 +1,206 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// DefaultLicenseAlgorithms are the signature algorithms accepted for licenses
+// by default.
+var DefaultLicenseAlgorithms = []jose.SignatureAlgorithm{
+	jose.EdDSA,
+	jose.ES256,
+	jose.ES384,
+	jose.ES512,
+}
+
+// SupportedLicenseAlgorithms are all signature algorithms which can be
+// configured to be accepted for licenses.
+var SupportedLicenseAlgorithms = []jose.SignatureAlgorithm{
+	jose.EdDSA,
+	jose.ES256,
+	jose.ES384,
+	jose.ES512,
+	jose.PS256,
+	jose.PS384,
+	jose.PS512,
+	jose.RS256,
+}
+
+// DefaultMinRSAKeySize is the default minimal size in bits of RSA keys used to
+// sign licenses.
+var DefaultMinRSAKeySize = 2048
+
+// ParseLicenseAlgorithms parses the provided algorithm names and returns them
+// as signature algorithms. Only SupportedLicenseAlgorithms are accepted.
+func ParseLicenseAlgorithms(names []string) ([]jose.SignatureAlgorithm, error) {
+	algorithms := make([]jose.SignatureAlgorithm, 0, len(names))
+	for _, name := range names {
+		alg := jose.SignatureAlgorithm(name)
+		if !containsAlgorithm(SupportedLicenseAlgorithms, alg) {
+			return nil, fmt.Errorf("unsupported license algorithm: %v", name)
+		}
+		algorithms = append(algorithms, alg)
+	}
+	return algorithms, nil
+}
+
+var (
+	errUnknownAlgorithm = errors.New("unknown alg")
+	errUnknownKeyID     = errors.New("unknown kid")
+	errNoOnlineKey      = errors.New("no matching online key")
+	errNoOfflineKey     = errors.New("no matching offline key")
+	errKeyTooSmall      = errors.New("key too small")
+	errNoDecryptionKey  = errors.New("no decryption key")
+)
+
+// Key sources, describing how the key which validated a license was found.
+const (
+	KeySourceCurrent        = "current"
+	KeySourceRetired        = "retired"
+	KeySourceCertChain      = "cert-chain"
+	KeySourceExtra          = "extra"
+	KeySourceExtraCertChain = "extra-cert-chain"
+)
+
+// A licenseKey is a key to validate signatures together with its provenance.
+type licenseKey struct {
+	key     interface{}
+	source  string
+	trusted bool
+}
+
+// findKey returns the key to validate the signature of the provided JWS in
+// compact serialization with the provided headers. Certificate chains are
+// validated at the provided signedAt time. If offlineOnly is true, online keys
+// are not used. If unsafe is true, a key with nil key value is returned instead
+// of an error if there is no matching key.
+func (ll *LicensesLoader) findKey(signed []byte, headers jose.Header, signedAt time.Time, offlineOnly bool, unsafe bool) (*licenseKey, error) {
+	algorithms := ll.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = DefaultLicenseAlgorithms
+	}
+	if !containsAlgorithm(algorithms, jose.SignatureAlgorithm(headers.Algorithm)) {
+		return nil, errUnknownAlgorithm
+	}
+
+	result := &licenseKey{}
+	if !offlineOnly {
+		if keys := jwksKey(ll.JWKS, headers.KeyID); len(keys) > 0 {
+			result.key = &keys[0]
+			result.source = KeySourceCurrent
+			result.trusted = ll.JWKSTrusted
+		} else if keys = jwksKey(ll.RetiredJWKS, headers.KeyID); len(keys) > 0 {
+			result.key = &keys[0]
+			result.source = KeySourceRetired
+			result.trusted = ll.JWKSTrusted
+		} else if keys = jwksKey(ll.ExtraJWKS, headers.KeyID); len(keys) > 0 {
+			result.key = &keys[0]
+			result.source = KeySourceExtra
+		} else if ll.JWKS != nil && !unsafe {
+			return nil, errUnknownKeyID
+		}
+	}
+	if result.key == nil {
+		if !ll.Offline && !offlineOnly && !unsafe {
+			return nil, errNoOnlineKey
+		}
+		if ll.CertPool != nil || ll.ExtraCertPool != nil {
+			// If we have a certificate pool, try to validate with it in
+			// offline mode.
+			certs, certsErr := certificateChain(signed)
+			if certsErr == nil {
+				var leaf *x509.Certificate
+				source := KeySourceCertChain
+				leaf, certsErr = ll.verifyCertificateChain(certs, ll.CertPool, signedAt)
+				if certsErr == nil {
+					result.trusted = ll.CertPoolTrusted
+				} else if ll.ExtraCertPool != nil {
+					source = KeySourceExtraCertChain
+					leaf, certsErr = ll.verifyCertificateChain(certs, ll.ExtraCertPool, signedAt)
+				}
+				if certsErr == nil {
+					// Extract public key from chain.
+					result.key = leaf.PublicKey
+					result.source = source
+				}
+			}
+			if certsErr != nil {
+				return nil, fmt.Errorf("certificate check failed: %w", certsErr)
+			}
+		}
+		if result.key == nil && !unsafe {
+			return nil, errNoOfflineKey
+		}
+	}
+
+	if err := ll.checkKeySize(result.key); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func jwksKey(jwks *jose.JSONWebKeySet, kid string) []jose.JSONWebKey {
+	if jwks == nil {
+		return nil
+	}
+	return jwks.Key(kid)
+}
+
+// checkKeySize validates the size of the provided key, if it is a RSA key.
+func (ll *LicensesLoader) checkKeySize(key interface{}) error {
+	if jwk, ok := key.(*jose.JSONWebKey); ok {
+		key = jwk.Key
+	}
+	if rsaKey, ok := key.(*rsa.PublicKey); ok {
+		minSize := ll.MinRSAKeySize
+		if minSize == 0 {
+			minSize = DefaultMinRSAKeySize
+		}
+		if rsaKey.N.BitLen() < minSize {
+			return fmt.Errorf("%w: %d bits", errKeyTooSmall, rsaKey.N.BitLen())
+		}
+	}
+	return nil
+}
+
+func containsAlgorithm(algorithms []jose.SignatureAlgorithm, alg jose.SignatureAlgorithm) bool {
+	for _, v := range algorithms {
+		if v == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// logKeyError logs the provided error returned by findKey for licenses.
+func logKeyError(logger logrus.FieldLogger, headers jose.Header, err error) {
+	switch {
+	case errors.Is(err, errUnknownAlgorithm):
+		logger.WithField("alg", headers.Algorithm).Warnln("license with unknown alg, ignored")
+	case errors.Is(err, errUnknownKeyID):
+		logger.WithField("kid", headers.KeyID).Warnln("license with unknown kid, ignored")
+	case errors.Is(err, errNoOnlineKey):
+		logger.WithField("kid", headers.KeyID).Warnln("license found but there is no matching online key, skipped")
+	case errors.Is(err, errNoOfflineKey):
+		logger.WithField("kid", headers.KeyID).Warnln("license found but there is no matching offline key, skipped")
+	case errors.Is(err, errCertificateRevoked):
+		logger.WithField("kid", headers.KeyID).Warnln("license signer certificate is revoked, skipped")
+	case errors.Is(err, errKeyTooSmall):
+		logger.WithError(err).WithField("kid", headers.KeyID).Warnln("license signed with a key which is too small, ignored")
+	default:
+		logger.WithError(err).WithField("kid", headers.KeyID).Warnln("license certificate check failed, skipped")
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package license
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+)
+
+// ArmorType is the type used in the armor header and footer lines of armored
+// licenses.
+const ArmorType = "KOPANO LICENSE"
+
+var (
+	armorBegin = []byte("-----BEGIN " + ArmorType + "-----")
+	armorEnd   = []byte("-----END " + ArmorType + "-----")
+
+	// compactRegexp matches JWE and JWS compact serialization. The JOSE header
+	// always is a JSON object, means its base64 url encoded form starts with
+	// "eyJ". This avoids false positives for things like host names in text.
+	// JWE is matched first, its encrypted key is empty for ECDH-ES.
+	compactRegexp = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*(?:\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+|\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+)`)
+)
+
+// Armor returns the armored form of the provided raw license data.
+func Armor(raw []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(armorBegin)
+	buf.WriteByte('\n')
+	for len(raw) > 64 {
+		buf.Write(raw[:64])
+		buf.WriteByte('\n')
+		raw = raw[64:]
+	}
+	if len(raw) > 0 {
+		buf.Write(raw)
+		buf.WriteByte('\n')
+	}
+	buf.Write(armorEnd)
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Split finds all licenses in the provided data and returns the raw compact
+// form of each of them in the order found. Licenses can be either armored
+// blocks or plain compact JWS or JWE, one per line. All other data is ignored.
+// If no license is found, the trimmed data is returned as is, so licenses in
+// other serializations like JWS JSON are left to the parser.
+func Split(data []byte) [][]byte {
+	result := make([][]byte, 0)
+
+	var armored *bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if armored != nil {
+			switch {
+			case bytes.Equal(line, armorEnd):
+				if armored.Len() > 0 {
+					result = append(result, armored.Bytes())
+				}
+				armored = nil
+			case bytes.Contains(line, []byte(": ")):
+				// Ignore armor headers.
+			default:
+				armored.Write(line)
+			}
+			continue
+		}
+		if bytes.Equal(line, armorBegin) {
+			armored = &bytes.Buffer{}
+			continue
+		}
+		for _, match := range compactRegexp.FindAll(line, -1) {
+			result = append(result, match)
+		}
+	}
+
+	if len(result) == 0 {
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 {
+			result = append(result, trimmed)
+		}
+	}
+
+	return result
+}
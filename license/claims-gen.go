@@ -6,6 +6,8 @@
 package license
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
@@ -39,6 +41,25 @@ func GenerateClaims(params map[string][]string) (*Claims, error) {
 			claims.DisplayName = v
 		case "sin":
 			claims.SupportIdentificationNumber = v
+		case "bind.mid", "bind.host", "bind.cid":
+			multi = true
+			if claims.Binding == nil {
+				claims.Binding = &Binding{}
+			}
+			switch k {
+			case "bind.mid":
+				for _, mid := range values {
+					hash, hashErr := machineIDHash(mid)
+					if hashErr != nil {
+						return nil, hashErr
+					}
+					claims.Binding.MachineIDs = append(claims.Binding.MachineIDs, hash)
+				}
+			case "bind.host":
+				claims.Binding.Hostnames = append(claims.Binding.Hostnames, values...)
+			case "bind.cid":
+				claims.Binding.ClusterIDs = append(claims.Binding.ClusterIDs, values...)
+			}
 		default:
 			parts := strings.SplitN(k, ".", 2)
 			if len(parts) != 2 {
@@ -115,3 +136,20 @@ func GenerateClaims(params map[string][]string) (*Claims, error) {
 
 	return claims, nil
 }
+
+// machineIDHash returns the SHA256 hex hash of the provided machine ID as
+// used in Binding.MachineIDs. Values which already are such a hash, like the
+// ones logged by kustomerd, are returned in lower case.
+func machineIDHash(mid string) (string, error) {
+	mid = strings.ToLower(strings.TrimSpace(mid))
+	if mid == "" {
+		return "", fmt.Errorf("empty machine ID in bind.mid")
+	}
+	if len(mid) == sha256.Size*2 {
+		if _, err := hex.DecodeString(mid); err == nil {
+			return mid, nil
+		}
+	}
+	sum := sha256.Sum256([]byte(mid))
+	return hex.EncodeToString(sum[:]), nil
+}
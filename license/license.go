@@ -7,6 +7,7 @@ package license
 
 import (
 	"encoding/json"
+	"time"
 
 	"gopkg.in/square/go-jose.v2/jwt"
 )
@@ -51,16 +52,38 @@ type Kopano struct {
 	Products ProductSet `json:"products"`
 }
 
+// A Binding restricts a license to specific hosts. Each non-empty list must
+// contain a value matching the host for the license to be valid.
+type Binding struct {
+	// MachineIDs are SHA256 hex hashes of accepted /etc/machine-id values.
+	MachineIDs []string `json:"mid,omitempty"`
+	// Hostnames are glob patterns of accepted host names.
+	Hostnames []string `json:"host,omitempty"`
+	// ClusterIDs are accepted configured cluster identifiers.
+	ClusterIDs []string `json:"cid,omitempty"`
+}
+
 // Claims are the claims for Kopano licenses.
 type Claims struct {
 	*jwt.Claims
 
 	LicenseFileName string `json:"-"`
+	LicenseSource   string `json:"-"`
 	LicenseID       string `json:"-"`
 	Raw             []byte `json:"-"`
 
+	// GraceUntil is set when the license is expired but still valid until then.
+	GraceUntil time.Time `json:"-"`
+
+	// KeySource describes where the key which validated the license was
+	// found and KeyTrusted is true if that key is trusted.
+	KeySource  string `json:"-"`
+	KeyTrusted bool   `json:"-"`
+
 	LicenseFileID               string `json:"uid"`
 	DisplayName                 string `json:"dn"`
 	SupportIdentificationNumber string `json:"sin"`
 	Kopano                      Kopano `json:"k"`
+
+	Binding *Binding `json:"bind,omitempty"`
 }
@@ -7,11 +7,16 @@ package kustomer
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -26,6 +31,12 @@ import (
 // DefaultLicenseLeeway is the default leeway when comparing timestamps in licenses.
 var DefaultLicenseLeeway = 24 * time.Hour
 
+// DefaultLicenseIssuer is the default expected iss claim value of licenses.
+var DefaultLicenseIssuer = "kopano"
+
+// DefaultLicenseAudiences are the default accepted aud claim values of licenses.
+var DefaultLicenseAudiences = []string{"kopano"}
+
 const (
 	licenseSizeLimitBytes = 1024 * 1024
 )
@@ -38,9 +49,88 @@ type LicensesLoader struct {
 	// JWKS is the key set for license validation when not offline.
 	JWKS *jose.JSONWebKeySet
 
+	// RetiredJWKS are keys which were removed from JWKS recently. They are
+	// still accepted, so a broken key rotation does not deactivate licenses.
+	RetiredJWKS *jose.JSONWebKeySet
+
+	// ExtraJWKS and ExtraCertPool are additional keys and root certificates,
+	// used when there is no matching key in JWKS and CertPool.
+	ExtraJWKS     *jose.JSONWebKeySet
+	ExtraCertPool *x509.CertPool
+
+	// JWKSTrusted and CertPoolTrusted mark licenses validated with keys from
+	// JWKS (or RetiredJWKS) and CertPool as trusted. Licenses validated with keys from
+	// ExtraJWKS and ExtraCertPool are never trusted.
+	JWKSTrusted     bool
+	CertPoolTrusted bool
+
 	// Offline allows license valdation with keys from CertPool if not found in JWKS.
 	Offline bool
 
+	// Intermediates are intermediate certificates to build certificate
+	// chains to CertPool, in addition to the ones included in licenses.
+	Intermediates []*x509.Certificate
+
+	// CertExtKeyUsages are the accepted extended key usages of certificates
+	// signing licenses. If empty, DefaultLicenseCertExtKeyUsages are used.
+	CertExtKeyUsages []asn1.ObjectIdentifier
+
+	// CertPolicies are the accepted policies of certificates signing
+	// licenses. If not empty, certificates must have one of them.
+	CertPolicies []asn1.ObjectIdentifier
+
+	// CRLs are certificate revocation lists to check certificate chains.
+	CRLs []*pkix.CertificateList
+
+	// DecryptionKey is the private host key to decrypt encrypted licenses. If
+	// nil, encrypted licenses are skipped.
+	DecryptionKey *jose.JSONWebKey
+
+	// Algorithms are the accepted signature algorithms. If empty,
+	// DefaultLicenseAlgorithms are used.
+	Algorithms []jose.SignatureAlgorithm
+
+	// MinRSAKeySize is the minimal size in bits of RSA signing keys. If zero,
+	// DefaultMinRSAKeySize is used.
+	MinRSAKeySize int
+
+	// Include and Exclude are glob patterns for license file names. If empty,
+	// DefaultLicenseIncludePatterns and DefaultLicenseExcludePatterns are used.
+	Include []string
+	Exclude []string
+
+	// Recursive enables scanning of sub folders, for example per product.
+	Recursive bool
+
+	// Symlinks defines how symbolic links are handled when scanning.
+	Symlinks SymlinkPolicy
+
+	// Issuer is the expected iss claim value of licenses. If empty,
+	// DefaultLicenseIssuer is used.
+	Issuer string
+
+	// Audiences are the accepted aud claim values of licenses. Licenses must
+	// have at least one of them. If empty, DefaultLicenseAudiences are used.
+	Audiences []string
+
+	// Subject, if not empty, is the only accepted sub claim value of licenses.
+	// The sub claim of licenses is also accepted if its SHA256 hex hash matches,
+	// so Subject can be given in hashed form.
+	Subject string
+
+	// Host is the identity of the current host, matched against the binding
+	// claim of licenses. Bound licenses are rejected if nil.
+	Host *HostIdentity
+
+	// GracePeriod is the duration expired licenses stay valid after their
+	// expiry (plus DefaultLicenseLeeway). Licenses in their grace period have
+	// GraceUntil set. Disabled if zero.
+	GracePeriod time.Duration
+
+	// Revocations is the list of revoked licenses. If set, matching licenses
+	// are rejected.
+	Revocations *RevocationList
+
 	// Logger is the logger used. If nil, a standard logger is used.
 	Logger logrus.FieldLogger
 
@@ -53,12 +143,14 @@ type LicensesLoader struct {
 	OnRemove   func(*license.Claims)
 	OnNew      func(*license.Claims)
 	OnSkip     func(*license.Claims)
+	OnRevoke   func(*license.Claims)
+	OnGrace    func(*license.Claims)
 }
 
 // ScanFolder scans the provided folder for license files, loads, parses and
 // validates them all and returns the claim set for each currently valid license.
 func (ll *LicensesLoader) ScanFolder(licensesPath string, expected jwt.Expected) ([]*license.Claims, error) {
-	return ll.scanFolderForLicenseClaims(licensesPath, expected, false)
+	return ll.scanForLicenseClaims([]*LicenseSource{{Path: licensesPath}}, expected, false)
 }
 
 // UnsafeScanFolderWithoutVerification scans the provided folder for license
@@ -66,179 +158,394 @@ func (ll *LicensesLoader) ScanFolder(licensesPath string, expected jwt.Expected)
 // this function unsafe to use when its required to only return valid license
 // claim sets.
 func (ll *LicensesLoader) UnsafeScanFolderWithoutVerification(licensesPath string, expected jwt.Expected) ([]*license.Claims, error) {
-	return ll.scanFolderForLicenseClaims(licensesPath, expected, true)
+	return ll.scanForLicenseClaims([]*LicenseSource{{Path: licensesPath}}, expected, true)
+}
+
+// Scan scans all the provided sources in order, loads, parses and validates
+// all licenses found and returns the claim set for each currently valid
+// license. If the same license is found in multiple sources, the first source
+// wins. An error is returned only if none of the sources could be scanned.
+func (ll *LicensesLoader) Scan(sources []*LicenseSource, expected jwt.Expected) ([]*license.Claims, error) {
+	return ll.scanForLicenseClaims(sources, expected, false)
+}
+
+// Load loads, parses and validates all licenses found in the provided data and
+// returns the claim set for each currently valid license. The provided name is
+// used to identify the data in logs.
+func (ll *LicensesLoader) Load(name string, data []byte, expected jwt.Expected) []*license.Claims {
+	logger := ll.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	src := &LicenseSource{
+		Type: LicenseSourceTypeData,
+		Path: name,
+		Data: data,
+	}
+	return ll.loadLicenses(logger, src, name, data, expected, false)
 }
 
-func (ll *LicensesLoader) scanFolderForLicenseClaims(licensesPath string, expected jwt.Expected, unsafe bool) ([]*license.Claims, error) {
+func (ll *LicensesLoader) scanForLicenseClaims(sources []*LicenseSource, expected jwt.Expected, unsafe bool) ([]*license.Claims, error) {
 	logger := ll.Logger
 	if logger == nil {
 		logger = logrus.StandardLogger()
 	}
 
 	claims := make([]*license.Claims, 0)
+	seen := make(map[string]*license.Claims)
 
-	if files, readDirErr := ioutil.ReadDir(licensesPath); readDirErr == nil {
-		for _, info := range files {
-			if info.IsDir() {
+	var err error
+	var failed int
+	for _, src := range sources {
+		var loaded []*license.Claims
+		var scanErr error
+		switch src.Type {
+		case LicenseSourceTypeEnv:
+			loaded = ll.scanEnvForLicenseClaims(logger, src, expected, unsafe)
+		case LicenseSourceTypeData:
+			loaded = ll.loadLicenses(logger, src, src.Path, src.Data, expected, unsafe)
+		default:
+			loaded, scanErr = ll.scanFolderForLicenseClaims(logger, src, expected, unsafe)
+		}
+		if scanErr != nil {
+			if len(sources) > 1 {
+				logger.WithError(scanErr).WithField("source", src.String()).Errorln("failed to scan license source")
+			}
+			err = scanErr
+			failed++
+			continue
+		}
+		for _, c := range loaded {
+			if other, ok := seen[c.LicenseID]; ok {
+				logger.WithFields(logrus.Fields{
+					"name":   c.LicenseFileName,
+					"source": c.LicenseSource,
+					"other":  other.LicenseFileName,
+				}).Debugln("license already loaded from other source, ignored")
 				continue
 			}
-			fn := filepath.Join(licensesPath, info.Name())
-			if f, openErr := os.Open(fn); openErr == nil {
-				isNew := true
-				c := &license.Claims{
-					LicenseID:       fn,
-					LicenseFileName: fn,
-				}
-				if _, ok := ll.LoadHistory[c.LicenseID]; ok {
-					isNew = false
-				}
-				func() {
-					r := io.LimitReader(f, licenseSizeLimitBytes)
-					if raw, readErr := ioutil.ReadAll(r); readErr == nil {
-						c.Raw = bytes.TrimSpace(raw)
-						if token, parseErr := jwt.ParseSigned(string(c.Raw)); parseErr == nil {
-							if len(token.Headers) != 1 {
-								if isNew {
-									logger.WithField("name", fn).Warnln("license with multiple headers, ignored")
-								}
-								return
-							}
-							headers := token.Headers[0]
-							switch jose.SignatureAlgorithm(headers.Algorithm) {
-							case jose.EdDSA:
-							case jose.ES256:
-							case jose.ES384:
-							case jose.ES512:
-							default:
-								if isNew {
-									logger.WithFields(logrus.Fields{
-										"alg":  headers.Algorithm,
-										"name": fn,
-									}).Warnln("license with unknown alg, ignored")
-								}
-								return
-							}
-							var key interface{}
-							if ll.JWKS != nil {
-								keys := ll.JWKS.Key(headers.KeyID)
-								if len(keys) == 0 && !unsafe {
-									if isNew {
-										logger.WithFields(logrus.Fields{
-											"kid":  headers.KeyID,
-											"name": fn,
-										}).Warnln("license with unknown kid, ignored")
-									}
-									return
-								} else {
-									key = &keys[0]
-								}
-							}
-							if key == nil {
-								if !ll.Offline && !unsafe {
-									if isNew {
-										logger.WithFields(logrus.Fields{
-											"kid":  headers.KeyID,
-											"name": fn,
-										}).Warnln("license found but there is no matching online key, skipped")
-									}
-									return
-								}
-								if ll.CertPool != nil {
-									// If we have a certificate pool, try to validate the license with it
-									// in offline mode.
-									chain, certsErr := headers.Certificates(x509.VerifyOptions{
-										Roots: ll.CertPool,
-									})
-									if certsErr != nil {
-										if isNew {
-											logger.WithError(certsErr).WithFields(logrus.Fields{
-												"kid":  headers.KeyID,
-												"name": fn,
-											}).Warnln("license certificate check failed, skipped")
-										}
-										return
-									}
-									if len(chain) > 0 && len(chain[0]) > 0 {
-										// Extract public key from chain.
-										cert := chain[0][0]
-										key = cert.PublicKey
-									}
-								}
-								if key == nil && !unsafe {
-									if isNew {
-										logger.WithFields(logrus.Fields{
-											"kid":  headers.KeyID,
-											"name": fn,
-										}).Warnln("license found but there is no matching offline key, skipped")
-									}
-									return
-								}
-							}
-							var claimsErr error
-							if unsafe && key == nil {
-								claimsErr = token.UnsafeClaimsWithoutVerification(&c)
-							} else {
-								claimsErr = token.Claims(key, &c)
-							}
-							if claimsErr == nil {
-								if c.Claims.ID != "" {
-									c.LicenseID = c.Claims.ID
-								}
-								if _, ok := ll.LoadHistory[c.LicenseID]; ok {
-									isNew = false
-								}
-								if validateErr := c.Claims.ValidateWithLeeway(expected, DefaultLicenseLeeway); validateErr != nil {
-									if isNew {
-										logger.WithError(validateErr).WithField("name", fn).Warnln("license is not valid, skipped")
-									}
-									return
-								} else {
-									subject := strings.TrimSpace(c.Claims.Subject)
-									if subject == "" {
-										if isNew {
-											logger.WithFields(logrus.Fields{
-												"kid":  headers.KeyID,
-												"name": fn,
-											}).Warnln("license found but it's sub claim is empty, skipped")
-										}
-										return
-									}
-								}
-							} else {
-								if isNew {
-									logger.WithError(claimsErr).WithField("name", fn).Errorln("error while parsing license file claims")
-								}
-								return
-							}
-						} else {
-							if isNew {
-								logger.WithError(parseErr).WithField("name", fn).Errorln("error while parsing license file")
-							}
-							return
-						}
-					} else {
-						logger.WithError(readErr).WithField("name", fn).Errorln("error while reading license file")
-						return
-					}
-					// If reached here, all is good, add claims to result.
-					claims = append(claims, c)
-					if isNew {
-						logger.WithField("name", fn).Debugln("license is valid, loaded")
-					}
-				}()
-				f.Close()
-				if isNew && ll.LoadHistory != nil {
-					ll.LoadHistory[c.LicenseID] = c
-				}
+			seen[c.LicenseID] = c
+			claims = append(claims, c)
+		}
+	}
+	if failed > 0 && failed == len(sources) {
+		return nil, err
+	}
+
+	return ll.sortAndDeduplicate(claims)
+}
+
+func (ll *LicensesLoader) scanFolderForLicenseClaims(logger logrus.FieldLogger, src *LicenseSource, expected jwt.Expected, unsafe bool) ([]*license.Claims, error) {
+	claims := make([]*license.Claims, 0)
+
+	files, findErr := ll.findLicenseFiles(logger, src.Path)
+	if findErr != nil {
+		return nil, findErr
+	}
+	for _, fn := range files {
+		if f, openErr := os.Open(fn); openErr == nil {
+			r := io.LimitReader(f, licenseSizeLimitBytes)
+			raw, readErr := ioutil.ReadAll(r)
+			f.Close()
+			if readErr != nil {
+				logger.WithError(readErr).WithField("name", fn).Errorln("error while reading license file")
+				continue
+			}
+			claims = append(claims, ll.loadLicenses(logger, src, fn, raw, expected, unsafe)...)
+		} else {
+			logger.WithError(openErr).WithField("name", fn).Errorln("failed to read license file")
+		}
+	}
+
+	return claims, nil
+}
+
+func (ll *LicensesLoader) scanEnvForLicenseClaims(logger logrus.FieldLogger, src *LicenseSource, expected jwt.Expected, unsafe bool) []*license.Claims {
+	claims := make([]*license.Claims, 0)
+
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, src.Path) {
+			continue
+		}
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || parts[0] == src.Path {
+			continue
+		}
+		name := string(LicenseSourceTypeEnv) + ":" + parts[0]
+		claims = append(claims, ll.loadLicenses(logger, src, name, []byte(parts[1]), expected, unsafe)...)
+	}
+
+	return claims
+}
+
+// loadLicenses loads all licenses found in the provided raw data and returns
+// the claims of all licenses which are valid.
+func (ll *LicensesLoader) loadLicenses(logger logrus.FieldLogger, src *LicenseSource, fn string, raw []byte, expected jwt.Expected, unsafe bool) []*license.Claims {
+	claims := make([]*license.Claims, 0)
+
+	parts := license.Split(raw)
+	if len(parts) == 0 {
+		if _, ok := ll.LoadHistory[fn]; !ok {
+			logger.WithField("name", fn).Errorln("error while parsing license file, no license found")
+			if ll.LoadHistory != nil {
+				ll.LoadHistory[fn] = nil
+			}
+		}
+		return claims
+	}
+
+	for idx, part := range parts {
+		c := &license.Claims{
+			LicenseID:       fn,
+			LicenseFileName: fn,
+			LicenseSource:   src.String(),
+			Raw:             part,
+		}
+		fields := logrus.Fields{
+			"name":   fn,
+			"source": c.LicenseSource,
+		}
+		if len(parts) > 1 {
+			// Multiple licenses in the same file, identify each one by its
+			// position in the file.
+			c.LicenseID = fmt.Sprintf("%s#%d", fn, idx+1)
+			fields["index"] = idx + 1
+		}
+		isNew := true
+		if _, ok := ll.LoadHistory[c.LicenseID]; ok {
+			isNew = false
+		}
+		if ll.loadLicense(logger.WithFields(fields), src, c, &isNew, expected, unsafe) {
+			claims = append(claims, c)
+			if isNew {
+				logger.WithFields(fields).Debugln("license is valid, loaded")
+			}
+		}
+		if isNew && ll.LoadHistory != nil {
+			ll.LoadHistory[c.LicenseID] = c
+		}
+	}
+
+	return claims
+}
+
+// loadLicense parses and validates the license in the Raw field of the
+// provided claims. Returns true if the license is valid.
+func (ll *LicensesLoader) loadLicense(logger logrus.FieldLogger, src *LicenseSource, c *license.Claims, isNew *bool, expected jwt.Expected, unsafe bool) bool {
+	token, signed, parseErr := ll.parseLicense(c.Raw)
+	if parseErr != nil {
+		if *isNew {
+			if errors.Is(parseErr, errNoDecryptionKey) {
+				logger.Warnln("license is encrypted but there is no host key, skipped")
 			} else {
-				logger.WithError(openErr).WithField("name", fn).Errorln("failed to read license file")
+				logger.WithError(parseErr).Errorln("error while parsing license file")
 			}
 		}
+		return false
+	}
+	if len(token.Headers) != 1 {
+		if *isNew {
+			logger.Warnln("license with multiple headers, ignored")
+		}
+		return false
+	}
+	headers := token.Headers[0]
+	key, keyErr := ll.findKey(signed, headers, signingTime(token), src.OfflineOnly, unsafe)
+	if keyErr != nil {
+		if *isNew {
+			logKeyError(logger, headers, keyErr)
+		}
+		return false
+	}
+	var claimsErr error
+	if unsafe && key.key == nil {
+		claimsErr = token.UnsafeClaimsWithoutVerification(c)
 	} else {
-		return nil, readDirErr
+		claimsErr = token.Claims(key.key, c)
+		c.KeySource = key.source
+		c.KeyTrusted = key.trusted
+	}
+	if claimsErr != nil {
+		if *isNew {
+			logger.WithError(claimsErr).Errorln("error while parsing license file claims")
+		}
+		return false
+	}
+	if c.Claims.ID != "" {
+		c.LicenseID = c.Claims.ID
+	}
+	if _, ok := ll.LoadHistory[c.LicenseID]; ok {
+		*isNew = false
+	}
+	if by, revoked := ll.Revocations.IsRevoked(c); revoked {
+		if *isNew {
+			logger.WithFields(logrus.Fields{
+				"id":         c.LicenseID,
+				"revoked_by": by,
+			}).Warnln("license is revoked, skipped")
+			if ll.OnRevoke != nil {
+				ll.OnRevoke(c)
+			}
+		}
+		return false
+	}
+	if validateErr := c.Claims.ValidateWithLeeway(expected, DefaultLicenseLeeway); validateErr != nil {
+		if !errors.Is(validateErr, jwt.ErrExpired) || !ll.inGracePeriod(c, expected) {
+			if *isNew {
+				logger.WithError(validateErr).Warnln("license is not valid, skipped")
+			}
+			return false
+		}
+		c.GraceUntil = c.Claims.Expiry.Time().Add(DefaultLicenseLeeway + ll.GracePeriod)
+	}
+	if issuer := ll.expectedIssuer(); c.Claims.Issuer != issuer {
+		if *isNew {
+			logger.WithFields(logrus.Fields{
+				"iss":      c.Claims.Issuer,
+				"expected": issuer,
+			}).Warnln("license issuer mismatch, skipped")
+		}
+		return false
+	}
+	if audiences := ll.expectedAudiences(); !matchAnyAudience(c.Claims.Audience, audiences) {
+		if *isNew {
+			logger.WithFields(logrus.Fields{
+				"aud":      []string(c.Claims.Audience),
+				"expected": audiences,
+			}).Warnln("license audience mismatch, skipped")
+		}
+		return false
+	}
+	subject := strings.TrimSpace(c.Claims.Subject)
+	if subject == "" {
+		if *isNew {
+			logger.WithField("kid", headers.KeyID).Warnln("license found but it's sub claim is empty, skipped")
+		}
+		return false
+	}
+	if ll.Subject != "" && !matchSubject(subject, ll.Subject) {
+		if *isNew {
+			logger.WithFields(logrus.Fields{
+				"sub":      subject,
+				"expected": ll.Subject,
+			}).Warnln("license is for a different customer, skipped")
+		}
+		return false
+	}
+	if by, ok := ll.Host.CheckBinding(c.Binding); !ok {
+		if *isNew {
+			logger.WithField("binding", by).Warnln("license is bound to a different host, skipped")
+		}
+		return false
+	}
+	if c.KeySource == KeySourceRetired && *isNew {
+		logger.WithField("kid", headers.KeyID).Warnln("license is validated with a retired key, it stops working when the key overlap window ends")
+	}
+	if !c.GraceUntil.IsZero() {
+		// Log when the license enters its grace period, not only when new.
+		if previous := ll.LoadHistory[c.LicenseID]; *isNew || previous == nil || previous.GraceUntil.IsZero() {
+			logger.WithFields(logrus.Fields{
+				"id":          c.LicenseID,
+				"expiry":      c.Claims.Expiry.Time(),
+				"grace_until": c.GraceUntil,
+			}).Warnln("license is expired, grace period active - renew the license now")
+			if ll.OnGrace != nil {
+				ll.OnGrace(c)
+			}
+			if ll.LoadHistory != nil {
+				ll.LoadHistory[c.LicenseID] = c
+			}
+		}
 	}
 
-	return ll.sortAndDeduplicate(claims)
+	return true
+}
+
+// parseLicense parses the provided raw license and returns it together with
+// its JWS compact serialization. Encrypted licenses are decrypted with the
+// DecryptionKey first.
+func (ll *LicensesLoader) parseLicense(raw []byte) (*jwt.JSONWebToken, []byte, error) {
+	if bytes.Count(raw, []byte(".")) != 4 {
+		token, err := jwt.ParseSigned(string(raw))
+		return token, raw, err
+	}
+
+	// Five parts, means JWE compact serialization with a nested JWT.
+	if ll.DecryptionKey == nil {
+		return nil, nil, errNoDecryptionKey
+	}
+	encrypted, err := jose.ParseEncrypted(string(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	if cty, _ := encrypted.Header.ExtraHeaders[jose.HeaderContentType].(string); cty != "JWT" {
+		return nil, nil, errors.New("encrypted license without JWT content type")
+	}
+	if alg := jose.KeyAlgorithm(encrypted.Header.Algorithm); !containsKeyAlgorithm(LicenseKeyAlgorithms, alg) {
+		return nil, nil, fmt.Errorf("encrypted license with unsupported alg: %v", alg)
+	}
+	signed, err := encrypted.Decrypt(ll.DecryptionKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt license: %w", err)
+	}
+	token, err := jwt.ParseSigned(string(signed))
+	return token, signed, err
+}
+
+// signingTime returns the time when the provided token was signed, based on
+// its unverified iat claim. It is never later than now.
+func signingTime(token *jwt.JSONWebToken) time.Time {
+	now := time.Now()
+	claims := &jwt.Claims{}
+	if err := token.UnsafeClaimsWithoutVerification(claims); err != nil || claims.IssuedAt == nil {
+		return now
+	}
+	if iat := claims.IssuedAt.Time(); iat.Before(now) {
+		return iat
+	}
+	return now
+}
+
+func (ll *LicensesLoader) inGracePeriod(c *license.Claims, expected jwt.Expected) bool {
+	if ll.GracePeriod <= 0 || c.Claims.Expiry == nil {
+		return false
+	}
+	if expected.Time.IsZero() {
+		expected.Time = time.Now()
+	}
+	return c.Claims.ValidateWithLeeway(expected.WithTime(expected.Time.Add(-ll.GracePeriod)), DefaultLicenseLeeway) == nil
+}
+
+func (ll *LicensesLoader) expectedIssuer() string {
+	if ll.Issuer != "" {
+		return ll.Issuer
+	}
+	return DefaultLicenseIssuer
+}
+
+func (ll *LicensesLoader) expectedAudiences() []string {
+	if len(ll.Audiences) > 0 {
+		return ll.Audiences
+	}
+	return DefaultLicenseAudiences
+}
+
+func matchSubject(sub string, expected string) bool {
+	if sub == expected {
+		return true
+	}
+	h := sha256.Sum256([]byte(sub))
+	return hex.EncodeToString(h[:]) == expected
+}
+
+func matchAnyAudience(audience jwt.Audience, audiences []string) bool {
+	for _, aud := range audiences {
+		if audience.Contains(aud) {
+			return true
+		}
+	}
+	return false
 }
 
 func (ll *LicensesLoader) sortAndDeduplicate(claims []*license.Claims) ([]*license.Claims, error) {
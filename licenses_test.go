@@ -0,0 +1,854 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"stash.kopano.io/kgol/kustomer/license"
+)
+
+const testKeyID = "test-license-signing-key"
+
+func newTestLicensesLoader(t *testing.T) (*LicensesLoader, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	return &LicensesLoader{
+		JWKS: &jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{
+				Key:       publicKey,
+				KeyID:     testKeyID,
+				Algorithm: string(jose.EdDSA),
+				Use:       "sig",
+			}},
+		},
+		Logger: logger,
+	}, privateKey
+}
+
+func signTestLicense(t *testing.T, privateKey ed25519.PrivateKey, claims interface{}) []byte {
+	return signTestLicenseWithAlgorithm(t, jose.EdDSA, testKeyID, privateKey, claims)
+}
+
+func signTestLicenseWithAlgorithm(t *testing.T, alg jose.SignatureAlgorithm, kid string, privateKey interface{}, claims interface{}) []byte {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       privateKey,
+	}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(raw)
+}
+
+func newTestLicenseClaims(id string) *jwt.Claims {
+	now := time.Now()
+	return &jwt.Claims{
+		ID:        id,
+		Issuer:    "kopano",
+		Audience:  jwt.Audience{"kopano"},
+		Subject:   "test-customer",
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+}
+
+// loadTestLicense loads the provided raw license with the provided loader at
+// the provided time. If rejected is empty, the license must be valid and its
+// claims are returned. Otherwise the license must be rejected with a warning or
+// error whose message or error contains rejected.
+func loadTestLicense(t *testing.T, loader *LicensesLoader, raw []byte, now time.Time, rejected string) *license.Claims {
+	t.Helper()
+
+	logger, hook := test.NewNullLogger()
+	loader.Logger = logger
+
+	result := loader.Load("test", raw, jwt.Expected{
+		Time: now,
+	})
+
+	var reasons []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level > logrus.WarnLevel {
+			continue
+		}
+		reason := entry.Message
+		if err, ok := entry.Data[logrus.ErrorKey].(error); ok {
+			reason += ": " + err.Error()
+		}
+		reasons = append(reasons, reason)
+	}
+
+	if rejected == "" {
+		if len(result) != 1 {
+			t.Fatalf("expected license to be valid, got %v", reasons)
+		}
+		return result[0]
+	}
+	if len(result) != 0 {
+		t.Fatalf("expected license to be rejected with %q", rejected)
+	}
+	for _, reason := range reasons {
+		if strings.Contains(reason, rejected) {
+			return nil
+		}
+	}
+	t.Errorf("expected license to be rejected with %q, got %v", rejected, reasons)
+	return nil
+}
+
+func TestLoadIssuerAndAudience(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		issuer    string
+		audiences []string
+		claims    func(*jwt.Claims)
+		rejected  string
+	}{
+		{"defaults", "", nil, func(c *jwt.Claims) {}, ""},
+		{"issuer mismatch", "", nil, func(c *jwt.Claims) { c.Issuer = "other" }, "license issuer mismatch"},
+		{"issuer empty", "", nil, func(c *jwt.Claims) { c.Issuer = "" }, "license issuer mismatch"},
+		{"audience mismatch", "", nil, func(c *jwt.Claims) { c.Audience = jwt.Audience{"other"} }, "license audience mismatch"},
+		{"audience empty", "", nil, func(c *jwt.Claims) { c.Audience = nil }, "license audience mismatch"},
+		{"audience multiple", "", nil, func(c *jwt.Claims) { c.Audience = jwt.Audience{"other", "kopano"} }, ""},
+		{"configured issuer", "private", nil, func(c *jwt.Claims) { c.Issuer = "private" }, ""},
+		{"configured issuer mismatch", "private", nil, func(c *jwt.Claims) {}, "license issuer mismatch"},
+		{"configured audiences", "", []string{"private", "kopano"}, func(c *jwt.Claims) { c.Audience = jwt.Audience{"private"} }, ""},
+		{"configured audiences mismatch", "", []string{"private"}, func(c *jwt.Claims) {}, "license audience mismatch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, privateKey := newTestLicensesLoader(t)
+			loader.Issuer = tc.issuer
+			loader.Audiences = tc.audiences
+
+			claims := newTestLicenseClaims("test-license")
+			tc.claims(claims)
+
+			c := loadTestLicense(t, loader, signTestLicense(t, privateKey, claims), time.Now(), tc.rejected)
+			if c == nil {
+				return
+			}
+			if c.Claims.Issuer != claims.Issuer {
+				t.Errorf("expected iss %s, got %s", claims.Issuer, c.Claims.Issuer)
+			}
+			if !reflect.DeepEqual(c.Claims.Audience, claims.Audience) {
+				t.Errorf("expected aud %v, got %v", claims.Audience, c.Claims.Audience)
+			}
+		})
+	}
+}
+
+func TestLoadJSONSerialization(t *testing.T) {
+	loader, privateKey := newTestLicensesLoader(t)
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.EdDSA,
+		Key:       privateKey,
+	}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", testKeyID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(newTestLicenseClaims("test-license")).FullSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := loadTestLicense(t, loader, []byte(raw+"\n"), time.Now(), "")
+	if c.Claims.ID != "test-license" {
+		t.Errorf("unexpected license claims: %s", c.Claims.ID)
+	}
+}
+
+func TestLoadSubject(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		subject  string
+		sub      string
+		rejected string
+	}{
+		{"not strict", "", "other-customer", ""},
+		{"match", "test-customer", "test-customer", ""},
+		{"mismatch", "test-customer", "other-customer", "license is for a different customer"},
+		{"hashed match", "973dfe463ec85785f5f95af5ba3906eedb2d931c24e69824a89ea65dba4e813b", "test@example.com", ""},
+		{"hashed mismatch", "973dfe463ec85785f5f95af5ba3906eedb2d931c24e69824a89ea65dba4e813b", "other@example.com", "license is for a different customer"},
+		{"empty", "", " ", "sub claim is empty"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, privateKey := newTestLicensesLoader(t)
+			loader.Subject = tc.subject
+
+			claims := newTestLicenseClaims("test-license")
+			claims.Subject = tc.sub
+
+			c := loadTestLicense(t, loader, signTestLicense(t, privateKey, claims), time.Now(), tc.rejected)
+			if c != nil && c.Claims.Subject != tc.sub {
+				t.Errorf("expected sub %s, got %s", tc.sub, c.Claims.Subject)
+			}
+		})
+	}
+}
+
+func TestLoadBinding(t *testing.T) {
+	host := &HostIdentity{
+		MachineID: "7b2a3c",
+		Hostname:  "mail.example.com",
+		ClusterID: "cluster-1",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		host     *HostIdentity
+		binding  *license.Binding
+		rejected string
+	}{
+		{"unbound", host, nil, ""},
+		{"unbound without host", nil, nil, ""},
+		{"machine", host, &license.Binding{MachineIDs: []string{"other", "7b2a3c"}}, ""},
+		{"machine mismatch", host, &license.Binding{MachineIDs: []string{"other"}}, "license is bound to a different host"},
+		{"hostname", host, &license.Binding{Hostnames: []string{"*.example.com"}}, ""},
+		{"hostname mismatch", host, &license.Binding{Hostnames: []string{"*.example.org"}}, "license is bound to a different host"},
+		{"cluster", host, &license.Binding{ClusterIDs: []string{"cluster-1"}}, ""},
+		{"cluster mismatch", host, &license.Binding{ClusterIDs: []string{"cluster-2"}}, "license is bound to a different host"},
+		{"all", host, &license.Binding{MachineIDs: []string{"7b2a3c"}, Hostnames: []string{"mail.*"}, ClusterIDs: []string{"cluster-1"}}, ""},
+		{"partial mismatch", host, &license.Binding{MachineIDs: []string{"7b2a3c"}, ClusterIDs: []string{"cluster-2"}}, "license is bound to a different host"},
+		{"bound without host", nil, &license.Binding{ClusterIDs: []string{"cluster-1"}}, "license is bound to a different host"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, privateKey := newTestLicensesLoader(t)
+			loader.Host = tc.host
+
+			claims := &struct {
+				*jwt.Claims
+				Binding *license.Binding `json:"bind,omitempty"`
+			}{newTestLicenseClaims("test-license"), tc.binding}
+
+			c := loadTestLicense(t, loader, signTestLicense(t, privateKey, claims), time.Now(), tc.rejected)
+			if c != nil && !reflect.DeepEqual(c.Binding, tc.binding) {
+				t.Errorf("expected binding %+v, got %+v", tc.binding, c.Binding)
+			}
+		})
+	}
+}
+
+func TestLoadGeneratedBinding(t *testing.T) {
+	machineID := "4c1b1e8a2f0d4a3b9e6f7a8b9c0d1e2f"
+	sum := sha256.Sum256([]byte(machineID))
+	machineIDHash := hex.EncodeToString(sum[:])
+
+	dir, err := ioutil.TempDir("", "kustomer-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	machineIDFile := filepath.Join(dir, "machine-id")
+	if err = ioutil.WriteFile(machineIDFile, []byte(machineID+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(files []string) {
+		MachineIDFiles = files
+	}(MachineIDFiles)
+	MachineIDFiles = []string{machineIDFile}
+
+	host, err := NewHostIdentity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		mid      []string
+		rejected string
+	}{
+		{"machine id", []string{machineID}, ""},
+		{"machine id hash", []string{machineIDHash}, ""},
+		{"upper case machine id hash", []string{strings.ToUpper(machineIDHash)}, ""},
+		{"other machine id", []string{"0f1e2d3c4b5a69788796a5b4c3d2e1f0"}, "license is bound to a different host"},
+		{"any machine id", []string{"0f1e2d3c4b5a69788796a5b4c3d2e1f0", machineID}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, privateKey := newTestLicensesLoader(t)
+			loader.Host = host
+
+			claims, generateErr := license.GenerateClaims(map[string][]string{
+				"bind.mid": tc.mid,
+			})
+			if generateErr != nil {
+				t.Fatal(generateErr)
+			}
+			claims.Claims = newTestLicenseClaims(tc.name)
+
+			c := loadTestLicense(t, loader, signTestLicense(t, privateKey, claims), time.Now(), tc.rejected)
+			if c == nil {
+				return
+			}
+			for _, mid := range c.Binding.MachineIDs {
+				if len(mid) != 64 || strings.ToLower(mid) != mid {
+					t.Errorf("expected hashed machine id in binding, got %s", mid)
+				}
+			}
+			if !containsString(c.Binding.MachineIDs, machineIDHash) {
+				t.Errorf("expected machine id hash in binding, got %v", c.Binding.MachineIDs)
+			}
+		})
+	}
+
+	if _, err = license.GenerateClaims(map[string][]string{
+		"bind.mid": {" "},
+	}); err == nil {
+		t.Errorf("expected empty machine ID to be rejected")
+	}
+}
+
+func TestLoadGracePeriod(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		gracePeriod time.Duration
+		expired     time.Duration
+		rejected    string
+		grace       bool
+	}{
+		{"not expired", 0, -time.Hour, "", false},
+		{"expired", 0, 48 * time.Hour, "token is expired", false},
+		{"in leeway", 0, 12 * time.Hour, "", false},
+		{"in grace", 7 * 24 * time.Hour, 48 * time.Hour, "", true},
+		{"after grace", 24 * time.Hour, 72 * time.Hour, "token is expired", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, privateKey := newTestLicensesLoader(t)
+			loader.GracePeriod = tc.gracePeriod
+			loader.LoadHistory = make(map[string]*license.Claims)
+
+			var graced bool
+			loader.OnGrace = func(c *license.Claims) {
+				graced = true
+			}
+
+			now := time.Now()
+			claims := newTestLicenseClaims("test-license")
+			claims.IssuedAt = jwt.NewNumericDate(now.Add(-365 * 24 * time.Hour))
+			claims.NotBefore = claims.IssuedAt
+			claims.Expiry = jwt.NewNumericDate(now.Add(-tc.expired))
+
+			c := loadTestLicense(t, loader, signTestLicense(t, privateKey, claims), now, tc.rejected)
+			if tc.grace != graced {
+				t.Errorf("unexpected grace hook call, expected %v", tc.grace)
+			}
+			if c == nil {
+				return
+			}
+			var graceUntil time.Time
+			if tc.grace {
+				graceUntil = claims.Expiry.Time().Add(DefaultLicenseLeeway + tc.gracePeriod)
+			}
+			if !c.GraceUntil.Equal(graceUntil) {
+				t.Errorf("expected grace until %v, got %v", graceUntil, c.GraceUntil)
+			}
+		})
+	}
+}
+
+func TestLoadAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		algorithms []jose.SignatureAlgorithm
+		alg        jose.SignatureAlgorithm
+		key        *rsa.PrivateKey
+		rejected   string
+	}{
+		{"default EdDSA", nil, jose.EdDSA, nil, ""},
+		{"default PS256", nil, jose.PS256, rsaKey, "license with unknown alg"},
+		{"PS256", []jose.SignatureAlgorithm{jose.EdDSA, jose.PS256}, jose.PS256, rsaKey, ""},
+		{"PS512", []jose.SignatureAlgorithm{jose.PS512}, jose.PS512, rsaKey, ""},
+		{"RS256", []jose.SignatureAlgorithm{jose.RS256}, jose.RS256, rsaKey, ""},
+		{"RS256 not accepted", []jose.SignatureAlgorithm{jose.PS256}, jose.RS256, rsaKey, "license with unknown alg"},
+		{"EdDSA not accepted", []jose.SignatureAlgorithm{jose.PS256}, jose.EdDSA, nil, "license with unknown alg"},
+		{"PS256 weak key", []jose.SignatureAlgorithm{jose.PS256}, jose.PS256, weakRSAKey, "key too small: 1024 bits"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, privateKey := newTestLicensesLoader(t)
+			loader.Algorithms = tc.algorithms
+
+			claims := newTestLicenseClaims("test-license")
+
+			var raw []byte
+			kid := testKeyID
+			if tc.key != nil {
+				kid = "test-rsa-key"
+				loader.JWKS.Keys = append(loader.JWKS.Keys, jose.JSONWebKey{
+					Key:       tc.key.Public(),
+					KeyID:     kid,
+					Algorithm: string(tc.alg),
+					Use:       "sig",
+				})
+				raw = signTestLicenseWithAlgorithm(t, tc.alg, kid, tc.key, claims)
+			} else {
+				raw = signTestLicenseWithAlgorithm(t, tc.alg, kid, privateKey, claims)
+			}
+
+			c := loadTestLicense(t, loader, raw, time.Now(), tc.rejected)
+			if c != nil && c.KeySource != KeySourceCurrent {
+				t.Errorf("expected key source %s, got %s", KeySourceCurrent, c.KeySource)
+			}
+		})
+	}
+}
+
+func TestLoadEncrypted(t *testing.T) {
+	hostKey, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHostKey, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		decryptionKey *jose.JSONWebKey
+		alg           jose.KeyAlgorithm
+		rejected      string
+	}{
+		{"ECDH-ES", hostKey, jose.ECDH_ES, ""},
+		{"ECDH-ES+A256KW", hostKey, jose.ECDH_ES_A256KW, ""},
+		{"no host key", nil, jose.ECDH_ES, "license is encrypted but there is no host key"},
+		{"other host key", otherHostKey, jose.ECDH_ES, "failed to decrypt license"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, privateKey := newTestLicensesLoader(t)
+			loader.DecryptionKey = tc.decryptionKey
+
+			signer, signerErr := jose.NewSigner(jose.SigningKey{
+				Algorithm: jose.EdDSA,
+				Key:       privateKey,
+			}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", testKeyID))
+			if signerErr != nil {
+				t.Fatal(signerErr)
+			}
+			publicHostKey := hostKey.Public()
+			encrypter, encrypterErr := jose.NewEncrypter(jose.A256GCM, jose.Recipient{
+				Algorithm: tc.alg,
+				Key:       &publicHostKey,
+			}, (&jose.EncrypterOptions{}).WithContentType("JWT").WithType("JWT"))
+			if encrypterErr != nil {
+				t.Fatal(encrypterErr)
+			}
+			raw, serializeErr := jwt.SignedAndEncrypted(signer, encrypter).Claims(newTestLicenseClaims("test-license")).CompactSerialize()
+			if serializeErr != nil {
+				t.Fatal(serializeErr)
+			}
+
+			c := loadTestLicense(t, loader, []byte(raw), time.Now(), tc.rejected)
+			if c == nil {
+				return
+			}
+			if c.LicenseID != "test-license" || c.Claims.Subject != "test-customer" {
+				t.Errorf("unexpected claims of decrypted license: %s %s", c.LicenseID, c.Claims.Subject)
+			}
+			if c.KeySource != KeySourceCurrent {
+				t.Errorf("expected key source %s, got %s", KeySourceCurrent, c.KeySource)
+			}
+		})
+	}
+}
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert, key}
+}
+
+// newTestCertificateChain returns a new root certificate and a license signer
+// certificate issued by it.
+func newTestCertificateChain(t *testing.T, now time.Time) (*testCertificate, *testCertificate) {
+	root := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	signer := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test License Signer"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, root)
+	return root, signer
+}
+
+// signTestLicenseWithCertificates signs the provided claims with the key of
+// the provided signer, with the provided chain as x5c header.
+func signTestLicenseWithCertificates(t *testing.T, signer *testCertificate, chain []*x509.Certificate, claims interface{}) []byte {
+	x5c := make([]string, 0, len(chain))
+	for _, cert := range chain {
+		x5c = append(x5c, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	s, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       signer.key,
+	}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("x5c", x5c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.Signed(s).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(raw)
+}
+
+func TestLoadCertificateChain(t *testing.T) {
+	now := time.Now()
+	root := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             now.Add(-10 * 365 * 24 * time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil)
+	intermediate := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Test Intermediate CA"},
+		NotBefore:             now.Add(-5 * 365 * 24 * time.Hour),
+		NotAfter:              now.Add(5 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, root)
+	newSigner := func(serial int64, notBefore, notAfter time.Time, usage []x509.ExtKeyUsage, policies []asn1.ObjectIdentifier) *testCertificate {
+		return newTestCertificate(t, &x509.Certificate{
+			SerialNumber:      big.NewInt(serial),
+			Subject:           pkix.Name{CommonName: "Test License Signer"},
+			NotBefore:         notBefore,
+			NotAfter:          notAfter,
+			KeyUsage:          x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:       usage,
+			PolicyIdentifiers: policies,
+		}, intermediate)
+	}
+	codeSigning := []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	policy := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	signer := newSigner(10, now.Add(-time.Hour), now.Add(365*24*time.Hour), codeSigning, []asn1.ObjectIdentifier{policy})
+	expiredSigner := newSigner(11, now.Add(-3*365*24*time.Hour), now.Add(-365*24*time.Hour), codeSigning, nil)
+	clientAuthSigner := newSigner(12, now.Add(-time.Hour), now.Add(365*24*time.Hour), []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil)
+	revokedSigner := newSigner(13, now.Add(-time.Hour), now.Add(365*24*time.Hour), codeSigning, nil)
+
+	crlDER, err := intermediate.cert.CreateCRL(rand.Reader, intermediate.key, []pkix.RevokedCertificate{{
+		SerialNumber:   revokedSigner.cert.SerialNumber,
+		RevocationTime: now,
+	}}, now, now.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(crlDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleCRLDER, err := intermediate.cert.CreateCRL(rand.Reader, intermediate.key, nil, now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleCRL, err := x509.ParseCRL(staleCRLDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(root.cert)
+
+	for _, tc := range []struct {
+		name          string
+		signer        *testCertificate
+		x5c           []*x509.Certificate
+		intermediates []*x509.Certificate
+		policies      []asn1.ObjectIdentifier
+		crl           *pkix.CertificateList
+		iat           time.Time
+		rejected      string
+	}{
+		{"chain", signer, []*x509.Certificate{signer.cert, intermediate.cert}, nil, nil, crl, now, ""},
+		{"leaf only", signer, []*x509.Certificate{signer.cert}, nil, nil, crl, now, "certificate signed by unknown authority"},
+		{"leaf with intermediates", signer, []*x509.Certificate{signer.cert}, []*x509.Certificate{intermediate.cert}, nil, crl, now, ""},
+		{"expired signer", expiredSigner, []*x509.Certificate{expiredSigner.cert, intermediate.cert}, nil, nil, crl, now, "certificate has expired"},
+		{"expired signer at iat", expiredSigner, []*x509.Certificate{expiredSigner.cert, intermediate.cert}, nil, nil, crl, now.Add(-2 * 365 * 24 * time.Hour), ""},
+		{"usage mismatch", clientAuthSigner, []*x509.Certificate{clientAuthSigner.cert, intermediate.cert}, nil, nil, crl, now, "certificate extended key usage not accepted"},
+		{"policy", signer, []*x509.Certificate{signer.cert, intermediate.cert}, nil, []asn1.ObjectIdentifier{policy}, crl, now, ""},
+		{"policy mismatch", expiredSigner, []*x509.Certificate{expiredSigner.cert, intermediate.cert}, nil, []asn1.ObjectIdentifier{policy}, crl, now.Add(-2 * 365 * 24 * time.Hour), "certificate policy not accepted"},
+		{"revoked", revokedSigner, []*x509.Certificate{revokedSigner.cert, intermediate.cert}, nil, nil, crl, now, "license signer certificate is revoked"},
+		{"stale crl", signer, []*x509.Certificate{signer.cert, intermediate.cert}, nil, nil, staleCRL, now, "certificate revocation list is outdated"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, _ := newTestLicensesLoader(t)
+			loader.JWKS = nil
+			loader.Offline = true
+			loader.CertPool = certPool
+			loader.Intermediates = tc.intermediates
+			loader.CertPolicies = tc.policies
+			loader.CRLs = []*pkix.CertificateList{tc.crl}
+
+			claims := newTestLicenseClaims("test-license")
+			claims.IssuedAt = jwt.NewNumericDate(tc.iat)
+			claims.NotBefore = claims.IssuedAt
+			raw := signTestLicenseWithCertificates(t, tc.signer, tc.x5c, claims)
+
+			c := loadTestLicense(t, loader, raw, now, tc.rejected)
+			if c == nil {
+				return
+			}
+			if c.KeySource != KeySourceCertChain || c.KeyTrusted {
+				t.Errorf("expected untrusted key source %s, got %s (trusted %v)", KeySourceCertChain, c.KeySource, c.KeyTrusted)
+			}
+		})
+	}
+}
+
+func TestLoadKeySourceTrust(t *testing.T) {
+	loader, privateKey := newTestLicensesLoader(t)
+	extraPublicKey, extraPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retiredPublicKey, retiredPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.JWKSTrusted = true
+	loader.RetiredJWKS = &jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{
+			Key:       retiredPublicKey,
+			KeyID:     "test-retired-key",
+			Algorithm: string(jose.EdDSA),
+			Use:       "sig",
+		}},
+	}
+	loader.ExtraJWKS = &jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{
+			Key:       extraPublicKey,
+			KeyID:     "test-extra-key",
+			Algorithm: string(jose.EdDSA),
+			Use:       "sig",
+		}},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		kid     string
+		key     ed25519.PrivateKey
+		source  string
+		trusted bool
+	}{
+		{"jwks", testKeyID, privateKey, KeySourceCurrent, true},
+		{"retired jwks", "test-retired-key", retiredPrivateKey, KeySourceRetired, true},
+		{"extra jwks", "test-extra-key", extraPrivateKey, KeySourceExtra, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := signTestLicenseWithAlgorithm(t, jose.EdDSA, tc.kid, tc.key, newTestLicenseClaims(tc.name))
+			result := loader.Load("test", raw, jwt.Expected{
+				Time: time.Now(),
+			})
+			if len(result) != 1 {
+				t.Fatalf("expected license to be valid")
+			}
+			if result[0].KeySource != tc.source {
+				t.Errorf("unexpected key source %v", result[0].KeySource)
+			}
+			if result[0].KeyTrusted != tc.trusted {
+				t.Errorf("expected trusted %v, got %v", tc.trusted, result[0].KeyTrusted)
+			}
+		})
+	}
+
+	now := time.Now()
+	root, signer := newTestCertificateChain(t, now)
+	extraRoot, extraSigner := newTestCertificateChain(t, now)
+	certPool := x509.NewCertPool()
+	certPool.AddCert(root.cert)
+	extraCertPool := x509.NewCertPool()
+	extraCertPool.AddCert(extraRoot.cert)
+
+	for _, tc := range []struct {
+		name    string
+		signer  *testCertificate
+		source  string
+		trusted bool
+	}{
+		{"cert chain", signer, KeySourceCertChain, true},
+		{"extra cert chain", extraSigner, KeySourceExtraCertChain, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loader, _ := newTestLicensesLoader(t)
+			loader.JWKS = nil
+			loader.Offline = true
+			loader.CertPool = certPool
+			loader.CertPoolTrusted = true
+			loader.ExtraCertPool = extraCertPool
+
+			raw := signTestLicenseWithCertificates(t, tc.signer, []*x509.Certificate{tc.signer.cert}, newTestLicenseClaims(tc.name))
+			result := loader.Load("test", raw, jwt.Expected{
+				Time: now,
+			})
+			if len(result) != 1 {
+				t.Fatalf("expected license to be valid")
+			}
+			if result[0].KeySource != tc.source {
+				t.Errorf("unexpected key source %v", result[0].KeySource)
+			}
+			if result[0].KeyTrusted != tc.trusted {
+				t.Errorf("expected trusted %v, got %v", tc.trusted, result[0].KeyTrusted)
+			}
+		})
+	}
+}
+
+func TestLoadSignedJWKS(t *testing.T) {
+	now := time.Now()
+	newRoot := func() *testCertificate {
+		return newTestCertificate(t, &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Test Root CA"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(365 * 24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, nil)
+	}
+	root := newRoot()
+	otherRoot := newRoot()
+	newSigner := func(parent *testCertificate) *testCertificate {
+		return newTestCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "Test JWKS Signer"},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		}, parent)
+	}
+	signer := newSigner(root)
+	otherSigner := newSigner(otherRoot)
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(root.cert)
+
+	loader, _ := newTestLicensesLoader(t)
+	payload, err := json.Marshal(loader.JWKS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.JWKS = nil
+	loader.CertPool = certPool
+
+	for _, tc := range []struct {
+		name    string
+		signer  *testCertificate
+		cty     string
+		payload []byte
+		valid   bool
+	}{
+		{"signed", signer, SignedJWKSContentType, payload, true},
+		{"cty mismatch", signer, "JWT", payload, false},
+		{"other root", otherSigner, SignedJWKSContentType, payload, false},
+		{"no keys", signer, SignedJWKSContentType, []byte(`{"keys":[]}`), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			jwsSigner, signerErr := jose.NewSigner(jose.SigningKey{
+				Algorithm: jose.ES256,
+				Key:       tc.signer.key,
+			}, (&jose.SignerOptions{}).WithContentType(jose.ContentType(tc.cty)).WithHeader("x5c", []string{
+				base64.StdEncoding.EncodeToString(tc.signer.cert.Raw),
+			}))
+			if signerErr != nil {
+				t.Fatal(signerErr)
+			}
+			object, signErr := jwsSigner.Sign(tc.payload)
+			if signErr != nil {
+				t.Fatal(signErr)
+			}
+			raw, serializeErr := object.CompactSerialize()
+			if serializeErr != nil {
+				t.Fatal(serializeErr)
+			}
+
+			jwks, loadErr := loader.LoadSignedJWKS([]byte(raw), now)
+			if tc.valid && (loadErr != nil || len(jwks.Keys) != 1) {
+				t.Errorf("expected signed JWKS to be valid: %v", loadErr)
+			}
+			if !tc.valid && loadErr == nil {
+				t.Errorf("expected signed JWKS to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"stash.kopano.io/kgol/kustomer/license"
+)
+
+// DefaultRevocationListName is the name of the revocation list document, next
+// to the JWKS document.
+const DefaultRevocationListName = "revocations.jwt"
+
+// A RevocationList holds the identifiers of revoked licenses.
+type RevocationList struct {
+	// IDs are revoked license jti claim values.
+	IDs []string `json:"jti,omitempty"`
+	// FileIDs are revoked license uid claim values.
+	FileIDs []string `json:"uid,omitempty"`
+	// ProductLicenseIDs are revoked product lid claim values.
+	ProductLicenseIDs []string `json:"lid,omitempty"`
+}
+
+// RevocationClaims are the claims of a signed revocation list.
+type RevocationClaims struct {
+	*jwt.Claims
+
+	Revoked RevocationList `json:"revoked"`
+}
+
+// IsRevoked checks if the provided claims are revoked and if so returns the
+// claim which matched.
+func (rl *RevocationList) IsRevoked(c *license.Claims) (string, bool) {
+	if rl == nil {
+		return "", false
+	}
+	if c.Claims != nil && c.Claims.ID != "" && containsString(rl.IDs, c.Claims.ID) {
+		return "jti", true
+	}
+	if c.LicenseFileID != "" && containsString(rl.FileIDs, c.LicenseFileID) {
+		return "uid", true
+	}
+	for _, product := range c.Kopano.Products {
+		if product.LicenseID != "" && containsString(rl.ProductLicenseIDs, product.LicenseID) {
+			return "lid", true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of revoked entries.
+func (rl *RevocationList) Len() int {
+	if rl == nil {
+		return 0
+	}
+	return len(rl.IDs) + len(rl.FileIDs) + len(rl.ProductLicenseIDs)
+}
+
+// MergeRevocationLists returns a new RevocationList with the entries of all the
+// provided lists. Nil lists are ignored.
+func MergeRevocationLists(lists ...*RevocationList) *RevocationList {
+	merged := &RevocationList{}
+	for _, rl := range lists {
+		if rl == nil {
+			continue
+		}
+		merged.IDs = append(merged.IDs, rl.IDs...)
+		merged.FileIDs = append(merged.FileIDs, rl.FileIDs...)
+		merged.ProductLicenseIDs = append(merged.ProductLicenseIDs, rl.ProductLicenseIDs...)
+	}
+	return merged
+}
+
+// LoadRevocationList parses and validates the signed revocation list in the
+// provided data, with the same keys used for licenses. The provided name is
+// used to identify the data in errors.
+func (ll *LicensesLoader) LoadRevocationList(name string, data []byte) (*RevocationClaims, error) {
+	signed := bytes.TrimSpace(data)
+	token, err := jwt.ParseSigned(string(signed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse revocation list %s: %w", name, err)
+	}
+	if len(token.Headers) != 1 {
+		return nil, fmt.Errorf("revocation list %s with multiple headers", name)
+	}
+
+	key, err := ll.findKey(signed, token.Headers[0], signingTime(token), false, false)
+	if err != nil {
+		return nil, fmt.Errorf("revocation list %s key error: %w", name, err)
+	}
+
+	claims := &RevocationClaims{}
+	if err = token.Claims(key.key, claims); err != nil {
+		return nil, fmt.Errorf("failed to validate revocation list %s: %w", name, err)
+	}
+	if claims.Claims == nil {
+		return nil, fmt.Errorf("revocation list %s without claims", name)
+	}
+	// NOTE(longsleep): Time based claims are not validated on purpose. An old
+	// revocation list shall not stop revoking licenses.
+
+	return claims, nil
+}
+
+// A RevocationListFetcher defines the parameters how to fetch a signed
+// revocation list from URI.
+type RevocationListFetcher struct {
+	URIs      []*url.URL
+	UserAgent string
+
+	Client *http.Client
+	Logger logrus.FieldLogger
+
+	etag string
+}
+
+// Update fetches the revocation list from its URIs, trying them in order. It
+// returns nil data if nothing has changed since the last fetch and empty data
+// if there is no revocation list.
+func (rlf *RevocationListFetcher) Update(ctx context.Context) ([]byte, error) {
+	logger := rlf.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	var err error
+	for _, uri := range rlf.URIs {
+		var data []byte
+		data, err = rlf.fetch(ctx, uri)
+		if err == nil {
+			return data, nil
+		}
+		logger.WithError(err).Debugln("error while fetching revocation list from URI")
+	}
+
+	return nil, err
+}
+
+func (rlf *RevocationListFetcher) fetch(ctx context.Context, uri *url.URL) ([]byte, error) {
+	requestCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	request, requestErr := http.NewRequestWithContext(requestCtx, http.MethodGet, uri.String(), nil)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	if rlf.UserAgent != "" {
+		request.Header.Set("User-Agent", rlf.UserAgent)
+	}
+	if rlf.etag != "" {
+		request.Header.Set("If-None-Match", rlf.etag)
+	}
+
+	response, responseErr := rlf.Client.Do(request)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		// Nothing changed. Done for now.
+		return nil, nil
+	case http.StatusNotFound:
+		// No revocation list published.
+		rlf.etag = ""
+		return []byte{}, nil
+	case http.StatusOK:
+		data, readErr := ioutil.ReadAll(io.LimitReader(response.Body, licenseSizeLimitBytes))
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read revocation list from %s: %w", uri, readErr)
+		}
+		rlf.etag = response.Header.Get("ETag")
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unexpected response status %d when fetching revocation list from %s", response.StatusCode, uri)
+	}
+}
+
+// Reset resets the associated fetcher, so the next update does not depend on
+// any previous update.
+func (rlf *RevocationListFetcher) Reset() {
+	rlf.etag = ""
+}
+
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"stash.kopano.io/kgol/kustomer/license"
+)
+
+func TestRevocationListIsRevoked(t *testing.T) {
+	rl := &RevocationList{
+		IDs:               []string{"revoked-jti"},
+		FileIDs:           []string{"revoked-uid"},
+		ProductLicenseIDs: []string{"revoked-lid"},
+	}
+	newClaims := func(jti, uid string, lids ...string) *license.Claims {
+		c := &license.Claims{
+			Claims:        &jwt.Claims{ID: jti},
+			LicenseFileID: uid,
+		}
+		c.Kopano.Products = make(license.ProductSet)
+		for idx, lid := range lids {
+			c.Kopano.Products[string(rune('a'+idx))] = &license.Product{LicenseID: lid}
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name   string
+		rl     *RevocationList
+		claims *license.Claims
+		by     string
+	}{
+		{"not revoked", rl, newClaims("jti", "uid", "lid"), ""},
+		{"jti", rl, newClaims("revoked-jti", "uid", "lid"), "jti"},
+		{"uid", rl, newClaims("jti", "revoked-uid", "lid"), "uid"},
+		{"lid", rl, newClaims("jti", "uid", "lid", "revoked-lid"), "lid"},
+		{"jti before uid", rl, newClaims("revoked-jti", "revoked-uid"), "jti"},
+		{"other fields do not match", rl, newClaims("revoked-uid", "revoked-lid", "revoked-jti"), ""},
+		{"empty values", &RevocationList{IDs: []string{""}, FileIDs: []string{""}, ProductLicenseIDs: []string{""}}, newClaims("", "", ""), ""},
+		{"without claims", rl, &license.Claims{LicenseFileID: "revoked-uid"}, "uid"},
+		{"nil list", nil, newClaims("revoked-jti", "revoked-uid", "revoked-lid"), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			by, revoked := tc.rl.IsRevoked(tc.claims)
+			if by != tc.by || revoked != (tc.by != "") {
+				t.Errorf("expected revoked by %q, got %q (%v)", tc.by, by, revoked)
+			}
+		})
+	}
+}
+
+func TestMergeRevocationLists(t *testing.T) {
+	merged := MergeRevocationLists(nil, &RevocationList{
+		IDs: []string{"a"},
+	}, &RevocationList{
+		IDs:               []string{"b"},
+		FileIDs:           []string{"c"},
+		ProductLicenseIDs: []string{"d"},
+	})
+	if merged.Len() != 4 {
+		t.Errorf("expected 4 merged entries, got %d", merged.Len())
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, revoked := merged.IsRevoked(&license.Claims{Claims: &jwt.Claims{ID: id}}); !revoked {
+			t.Errorf("expected %s to be revoked after merge", id)
+		}
+	}
+	if (*RevocationList)(nil).Len() != 0 {
+		t.Errorf("expected nil list to be empty")
+	}
+}
+
+func TestLoadRevoked(t *testing.T) {
+	loader, privateKey := newTestLicensesLoader(t)
+	logger, hook := test.NewNullLogger()
+	loader.Logger = logger
+	loader.LoadHistory = make(map[string]*license.Claims)
+	loader.Revocations = &RevocationList{
+		IDs: []string{"revoked"},
+	}
+	var revoked []string
+	loader.OnRevoke = func(c *license.Claims) {
+		revoked = append(revoked, c.LicenseID)
+	}
+
+	for _, id := range []string{"valid", "revoked"} {
+		result := loader.Load(id, signTestLicense(t, privateKey, newTestLicenseClaims(id)), jwt.Expected{
+			Time: time.Now(),
+		})
+		if id == "valid" && (len(result) != 1 || result[0].LicenseID != "valid") {
+			t.Errorf("expected license which is not revoked to be valid")
+		}
+		if id == "revoked" && len(result) != 0 {
+			t.Errorf("expected revoked license to be rejected")
+		}
+	}
+	if len(revoked) != 1 || revoked[0] != "revoked" {
+		t.Errorf("expected revoke hook for the revoked license, got %v", revoked)
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Message != "license is revoked, skipped" || entry.Data["revoked_by"] != "jti" {
+		t.Errorf("expected revoked license to be logged, got %v", entry)
+	}
+
+	// Known revoked licenses are neither logged nor reported again.
+	hook.Reset()
+	loader.Load("revoked", signTestLicense(t, privateKey, newTestLicenseClaims("revoked")), jwt.Expected{
+		Time: time.Now(),
+	})
+	if len(revoked) != 1 || len(hook.AllEntries()) != 0 {
+		t.Errorf("expected known revoked license to be skipped silently")
+	}
+}
+
+func TestLoadRevocationList(t *testing.T) {
+	loader, privateKey := newTestLicensesLoader(t)
+	_, otherPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name  string
+		key   ed25519.PrivateKey
+		kid   string
+		data  func([]byte) []byte
+		valid bool
+	}{
+		{"signed", privateKey, testKeyID, func(raw []byte) []byte { return raw }, true},
+		{"with whitespace", privateKey, testKeyID, func(raw []byte) []byte { return append(append([]byte("\n"), raw...), '\n') }, true},
+		{"other key", otherPrivateKey, testKeyID, func(raw []byte) []byte { return raw }, false},
+		{"unknown kid", otherPrivateKey, "other-key", func(raw []byte) []byte { return raw }, false},
+		{"garbage", privateKey, testKeyID, func(raw []byte) []byte { return []byte("not a jwt") }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := signTestLicenseWithAlgorithm(t, jose.EdDSA, tc.kid, tc.key, &RevocationClaims{
+				Claims: &jwt.Claims{
+					Issuer:   "kopano",
+					IssuedAt: jwt.NewNumericDate(now.Add(-365 * 24 * time.Hour)),
+					Expiry:   jwt.NewNumericDate(now.Add(-30 * 24 * time.Hour)),
+				},
+				Revoked: RevocationList{
+					IDs:     []string{"revoked-jti"},
+					FileIDs: []string{"revoked-uid"},
+				},
+			})
+			claims, loadErr := loader.LoadRevocationList("test", tc.data(raw))
+			if !tc.valid {
+				if loadErr == nil {
+					t.Errorf("expected revocation list to be rejected")
+				}
+				return
+			}
+			if loadErr != nil {
+				t.Fatalf("expected revocation list to be valid: %v", loadErr)
+			}
+			// Expired revocation lists stay in effect.
+			if claims.Revoked.Len() != 2 {
+				t.Errorf("expected 2 revoked entries, got %d", claims.Revoked.Len())
+			}
+			if by, _ := claims.Revoked.IsRevoked(&license.Claims{LicenseFileID: "revoked-uid"}); by != "uid" {
+				t.Errorf("expected uid to be revoked, got %q", by)
+			}
+		})
+	}
+}
@@ -17,7 +17,20 @@ type ClaimsGenResponse struct {
 }
 
 // ClaimsResponse is the response model for the claims API endpoint response.
-type ClaimsResponse []*license.Claims
+type ClaimsResponse []*ClaimsResponseLicense
+
+// ClaimsResponseLicense is the individual license entry returned by the claims
+// API endpoint.
+type ClaimsResponseLicense struct {
+	*license.Claims
+
+	Name   string `json:"name,omitempty"`
+	Source string `json:"source,omitempty"`
+	Grace  bool   `json:"grace,omitempty"`
+
+	Trusted   bool   `json:"trusted"`
+	KeySource string `json:"key_source,omitempty"`
+}
 
 // ClaimsKopanoProductsResponse defines the response model of the claims kopano
 // products API endpoint.
@@ -25,16 +38,60 @@ type ClaimsKopanoProductsResponse struct {
 	Trusted  bool                                            `json:"trusted"`
 	Offline  bool                                            `json:"offline"`
 	Products map[string]*ClaimsKopanoProductsResponseProduct `json:"products"`
+
+	Connectivity *ConnectivityResponse `json:"connectivity"`
+}
+
+// HealthResponse defines the response model of the health API endpoints. Times
+// are Unix timestamps in seconds.
+type HealthResponse struct {
+	Live      bool  `json:"live"`
+	Ready     bool  `json:"ready"`
+	Heartbeat int64 `json:"heartbeat,omitempty"`
+	LastScan  int64 `json:"last_scan,omitempty"`
+
+	Connectivity *ConnectivityResponse `json:"connectivity"`
+}
+
+// ConnectivityResponse defines the online state of the server. Times are Unix
+// timestamps in seconds, zero if there was none yet.
+type ConnectivityResponse struct {
+	State       string `json:"state"`
+	Offline     bool   `json:"offline"`
+	Failures    uint   `json:"failures"`
+	Since       int64  `json:"since"`
+	LastSuccess int64  `json:"last_success,omitempty"`
+	LastFailure int64  `json:"last_failure,omitempty"`
 }
 
 // ClaimsKopanoProductsResponseProduct is the individual product entryu for
 // products returned by the kopano products API endpoint.
 type ClaimsKopanoProductsResponseProduct struct {
 	OK                          bool                   `json:"ok"`
+	Trusted                     bool                   `json:"trusted"`
 	Claims                      map[string]interface{} `json:"claims"`
 	Expiry                      []*jwt.NumericDate     `json:"expiry"`
 	DisplayName                 []string               `json:"dn"`
 	SupportIdentificationNumber []string               `json:"sin"`
+	Grace                       bool                   `json:"grace"`
+	GraceRemaining              int64                  `json:"grace_remaining,omitempty"`
 
 	ExclusiveClaims map[string]interface{} `json:"-"`
 }
+
+// HistoryResponse defines the response model of the history API endpoint.
+type HistoryResponse struct {
+	Entries []*HistoryEntry `json:"entries"`
+}
+
+// HistoryEntry is a snapshot of the effective claims after they have changed.
+// Time is a Unix timestamp in seconds. Added and Removed are the license IDs
+// which changed compared to the previous entry.
+type HistoryEntry struct {
+	Time     int64                                           `json:"time"`
+	Trigger  string                                          `json:"trigger"`
+	Added    []string                                        `json:"added"`
+	Removed  []string                                        `json:"removed"`
+	Licenses []string                                        `json:"licenses"`
+	Products map[string]*ClaimsKopanoProductsResponseProduct `json:"products"`
+}
@@ -0,0 +1,287 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kgol/kustomer/license"
+)
+
+// Audit events.
+const (
+	auditEventLicenseActivated = "license-activated"
+	auditEventLicenseReplaced  = "license-replaced"
+	auditEventLicenseExpired   = "license-expired"
+	auditEventLicenseRemoved   = "license-removed"
+	auditEventLicenseRevoked   = "license-revoked"
+
+	auditEventClaimsRead     = "claims-read"
+	auditEventReload         = "reload"
+	auditEventReloadRejected = "reload-rejected"
+)
+
+// Default audit log settings.
+const (
+	DefaultAuditLogMaxSize   int64 = 100 * 1024 * 1024
+	DefaultAuditLogRetention       = 90 * 24 * time.Hour
+)
+
+// auditRotatedTimeFormat is the time format of the suffix of rotated audit
+// log files.
+const auditRotatedTimeFormat = "20060102T150405.000000000Z"
+
+// An auditRecord is a single line of the audit log.
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Trigger string    `json:"trigger,omitempty"`
+
+	License *auditLicense `json:"license,omitempty"`
+
+	Path   string       `json:"path,omitempty"`
+	Remote *auditRemote `json:"remote,omitempty"`
+}
+
+// An auditLicense identifies a license in the audit log.
+type auditLicense struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Source   string   `json:"source,omitempty"`
+	Sub      string   `json:"sub,omitempty"`
+	Products []string `json:"products,omitempty"`
+	Expiry   int64    `json:"expiry,omitempty"`
+}
+
+// An auditRemote identifies the local process of an API request in the audit
+// log.
+type auditRemote struct {
+	UID uint32 `json:"uid"`
+	PID int32  `json:"pid"`
+	Exe string `json:"exe,omitempty"`
+}
+
+// newAuditLicense returns the audit log representation of the provided
+// license claims.
+func newAuditLicense(c *license.Claims) *auditLicense {
+	l := &auditLicense{
+		ID:       c.LicenseID,
+		Name:     c.LicenseFileName,
+		Source:   c.LicenseSource,
+		Products: make([]string, 0, len(c.Kopano.Products)),
+	}
+	if c.Claims != nil {
+		l.Sub = c.Claims.Subject
+		if c.Claims.Expiry != nil {
+			l.Expiry = c.Claims.Expiry.Time().Unix()
+		}
+	}
+	for name := range c.Kopano.Products {
+		l.Products = append(l.Products, name)
+	}
+	return l
+}
+
+// newAuditRemote returns the audit log representation of the local process
+// which sent the provided request, or nil if the request has no unix
+// credentials.
+func newAuditRemote(req *http.Request) *auditRemote {
+	ucred, ok := GetUcredContextValue(req.Context())
+	if !ok || ucred == nil {
+		return nil
+	}
+	r := &auditRemote{
+		UID: ucred.Uid,
+		PID: ucred.Pid,
+	}
+	// This fails for processes of other users, unless running privileged.
+	if exe, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(int(ucred.Pid)), "exe")); err == nil {
+		r.Exe = exe
+	}
+	return r
+}
+
+// An auditLog is an append only log file, writing one JSON record per line.
+// It rotates the file when it reaches its maximum size and removes rotated
+// files when they are older than the retention.
+type auditLog struct {
+	mutex sync.Mutex
+
+	path      string
+	maxSize   int64
+	retention time.Duration
+	logger    logrus.FieldLogger
+
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// newAuditLog opens the audit log at the provided path.
+func newAuditLog(path string, maxSize int64, retention time.Duration, logger logrus.FieldLogger) (*auditLog, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit log path: %w", err)
+	}
+	a := &auditLog{
+		path:      absPath,
+		maxSize:   maxSize,
+		retention: retention,
+		logger:    logger.WithField("path", absPath),
+	}
+	if err = a.open(); err != nil {
+		return nil, err
+	}
+	a.prune(time.Now())
+	return a, nil
+}
+
+// open opens the file of the associated audit log for appending. The caller
+// is responsible to hold the lock.
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a.f = f
+	a.size = info.Size()
+	return nil
+}
+
+// record appends the provided record to the associated audit log. It is a
+// no-op if the audit log is nil.
+func (a *auditLog) record(r *auditRecord) {
+	if a == nil {
+		return
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		a.logger.WithError(err).Errorln("failed to encode audit record")
+		return
+	}
+	data = append(data, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.closed {
+		return
+	}
+	if a.f != nil && a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err = a.rotate(r.Time); err != nil {
+			a.logger.WithError(err).Errorln("failed to rotate audit log")
+		}
+	}
+	if a.f == nil {
+		if err = a.open(); err != nil {
+			a.logger.WithError(err).WithField("event", r.Event).Errorln("failed to write audit record")
+			return
+		}
+	}
+	n, err := a.f.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		a.logger.WithError(err).WithField("event", r.Event).Errorln("failed to write audit record")
+	}
+}
+
+// rotate renames the file of the associated audit log with the provided time
+// as suffix and opens a new file. The caller is responsible to hold the lock.
+func (a *auditLog) rotate(now time.Time) error {
+	a.f.Close()
+	a.f = nil
+	if err := os.Rename(a.path, a.path+"."+now.UTC().Format(auditRotatedTimeFormat)); err != nil {
+		return err
+	}
+	a.logger.Debugln("audit log rotated")
+	a.prune(now)
+	return a.open()
+}
+
+// prune removes all rotated files of the associated audit log which were last
+// modified before the retention at the provided time.
+func (a *auditLog) prune(now time.Time) {
+	if a.retention <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(a.path + ".*")
+	if err != nil {
+		return
+	}
+	for _, fn := range matches {
+		if _, parseErr := time.Parse(auditRotatedTimeFormat, fn[len(a.path)+1:]); parseErr != nil {
+			// Not a rotated file.
+			continue
+		}
+		info, statErr := os.Stat(fn)
+		if statErr != nil || now.Sub(info.ModTime()) < a.retention {
+			continue
+		}
+		if removeErr := os.Remove(fn); removeErr != nil {
+			a.logger.WithError(removeErr).WithField("name", fn).Warnln("failed to remove expired audit log")
+			continue
+		}
+		a.logger.WithField("name", fn).Debugln("expired audit log removed")
+	}
+}
+
+// reopen closes and opens the file of the associated audit log, to support
+// external log rotation, and removes expired rotated files. It is a no-op if
+// the audit log is nil.
+func (a *auditLog) reopen() {
+	if a == nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.closed {
+		return
+	}
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+	if err := a.open(); err != nil {
+		a.logger.WithError(err).Errorln("failed to reopen audit log")
+	}
+	a.prune(time.Now())
+}
+
+// close closes the file of the associated audit log. Records are discarded
+// afterwards. It is a no-op if the audit log is nil.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+	a.closed = true
+}
@@ -0,0 +1,190 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestAuditLog(t *testing.T, maxSize int64, retention time.Duration) (*auditLog, string, func()) {
+	dir, err := ioutil.TempDir("", "kustomer-audit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuditLog(filepath.Join(dir, "audit.log"), maxSize, retention, newTestLogger())
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return a, dir, func() {
+		a.close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readTestAuditLog(t *testing.T, fn string) []*auditRecord {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []*auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := &auditRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), r); err != nil {
+			t.Fatalf("invalid audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func listTestAuditLogs(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(matches))
+	for _, fn := range matches {
+		names = append(names, filepath.Base(fn))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	a, dir, cleanup := newTestAuditLog(t, 300, 0)
+	defer cleanup()
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	for idx := 0; idx < 6; idx++ {
+		a.record(&auditRecord{
+			Time:    now.Add(time.Duration(idx) * time.Second),
+			Event:   auditEventReload,
+			Trigger: "signal",
+		})
+	}
+
+	names := listTestAuditLogs(t, dir)
+	if len(names) < 2 || names[0] != "audit.log" {
+		t.Fatalf("expected audit log to be rotated, got %v", names)
+	}
+	var count int
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("expected %s to be rotated at max size, got %d bytes", name, info.Size())
+		}
+		if name != "audit.log" {
+			if _, err = time.Parse(auditRotatedTimeFormat, name[len("audit.log."):]); err != nil {
+				t.Errorf("unexpected rotated file name %s: %v", name, err)
+			}
+		}
+		count += len(readTestAuditLog(t, filepath.Join(dir, name)))
+	}
+	if count != 6 {
+		t.Errorf("expected 6 records in all files, got %d", count)
+	}
+
+	// Reopen continues appending to the current file.
+	before := len(readTestAuditLog(t, a.path))
+	a.reopen()
+	a.record(&auditRecord{
+		Event: auditEventClaimsRead,
+	})
+	if after := len(readTestAuditLog(t, a.path)); after != before+1 {
+		t.Errorf("expected record to be appended after reopen, got %d records, had %d", after, before)
+	}
+}
+
+func TestAuditLogPrune(t *testing.T) {
+	a, dir, cleanup := newTestAuditLog(t, 0, time.Hour)
+	defer cleanup()
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name    string
+		modTime time.Time
+	}{
+		{"audit.log.20210301T120000.000000000Z", now.Add(-2 * time.Hour)},
+		{"audit.log.20210301T130000.000000000Z", now.Add(-time.Minute)},
+		{"audit.log.old", now.Add(-2 * time.Hour)},
+		{"audit.log.20210301", now.Add(-2 * time.Hour)},
+		{"audit.log.20210301T120000.000000000Z.gz", now.Add(-2 * time.Hour)},
+		{"other.log.20210301T120000.000000000Z", now.Add(-2 * time.Hour)},
+	} {
+		fn := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(fn, []byte("{}\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, tc.modTime, tc.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.prune(now)
+
+	expected := []string{
+		"audit.log",
+		"audit.log.20210301",
+		"audit.log.20210301T120000.000000000Z.gz",
+		"audit.log.20210301T130000.000000000Z",
+		"audit.log.old",
+		"other.log.20210301T120000.000000000Z",
+	}
+	names := listTestAuditLogs(t, dir)
+	if len(names) != len(expected) {
+		t.Fatalf("expected files %v, got %v", expected, names)
+	}
+	for idx, name := range expected {
+		if names[idx] != name {
+			t.Errorf("expected files %v, got %v", expected, names)
+			break
+		}
+	}
+}
+
+func TestAuditLogClose(t *testing.T) {
+	a, _, cleanup := newTestAuditLog(t, 0, 0)
+	defer cleanup()
+
+	a.record(&auditRecord{
+		Event: auditEventReload,
+	})
+	a.close()
+	a.record(&auditRecord{
+		Event: auditEventClaimsRead,
+	})
+	a.reopen()
+	a.record(&auditRecord{
+		Event: auditEventClaimsRead,
+	})
+
+	records := readTestAuditLog(t, a.path)
+	if len(records) != 1 || records[0].Event != auditEventReload {
+		t.Errorf("expected records after close to be dropped, got %d records", len(records))
+	}
+
+	// A nil audit log is a no-op.
+	var disabled *auditLog
+	disabled.record(&auditRecord{
+		Event: auditEventReload,
+	})
+	disabled.reopen()
+	disabled.close()
+}
@@ -54,7 +54,7 @@ func (c *Collector) Collect(ch chan<- ksurveyclient.Metric) {
 			sub = hashSub(sub)
 		}
 		licenseCustomer = appendIfMissing(licenseCustomer, sub)
-		if validateErr := claim.ValidateWithLeeway(expected, kustomer.DefaultLicenseLeeway); validateErr != nil {
+		if validateErr := claim.ValidateWithLeeway(expected, kustomer.DefaultLicenseLeeway); validateErr != nil && (claim.GraceUntil.IsZero() || expected.Time.After(claim.GraceUntil)) {
 			c.logger.WithField("name", claim.LicenseFileName).WithError(validateErr).Warnln("license is not valid")
 			continue
 		}
@@ -7,25 +7,92 @@ package server
 
 import (
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net"
 	"net/url"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+
+	"stash.kopano.io/kgol/kustomer"
 )
 
 // Config bundles configuration settings.
 type Config struct {
-	Sub string
+	Sub       string
+	StrictSub bool
+	ClusterID string
+
+	LicenseSources    []*kustomer.LicenseSource
+	LicensesInclude   []string
+	LicensesExclude   []string
+	LicensesRecursive bool
+	LicensesSymlinks  kustomer.SymlinkPolicy
+	LicensesIssuer    string
+	LicensesAudiences []string
+
+	LicensesGracePeriod time.Duration
+
+	LicensesKeyOverlap time.Duration
+
+	LicensesAlgorithms    []jose.SignatureAlgorithm
+	LicensesMinRSAKeySize int
+
+	LicensesIntermediates    []*x509.Certificate
+	LicensesCertExtKeyUsages []asn1.ObjectIdentifier
+	LicensesCertPolicies     []asn1.ObjectIdentifier
+	LicensesCRLs             []*pkix.CertificateList
+
+	HostKey *jose.JSONWebKey
+
+	LicensesFetchURI      *url.URL
+	LicensesFetchPath     string
+	LicensesFetchInterval time.Duration
 
-	LicensesPath string
-	ListenPath   string
+	ListenPath string
+	StatePath  string
+
+	// Listener, if set, is used for API requests instead of creating a
+	// listener at ListenPath, for example with socket activation.
+	Listener net.Listener
+
+	RevocationsFile string
+
+	// AuditLogPath, if set, enables the audit log of license lifecycle and
+	// API access, rotated at AuditLogMaxSize bytes and with rotated files
+	// removed after AuditLogRetention.
+	AuditLogPath      string
+	AuditLogMaxSize   int64
+	AuditLogRetention time.Duration
+
+	// HistoryRetention is the duration entries of the history of effective
+	// claims in the StatePath are kept, zero to keep them forever.
+	HistoryRetention time.Duration
 
 	Insecure bool
 
-	Trusted  bool
-	JWKSURIs []*url.URL
-	CertPool *x509.CertPool
+	Trusted        bool
+	JWKSURIs       []*url.URL
+	JWKSSigned     bool
+	JWKSHedgeDelay time.Duration
+	CertPool       *x509.CertPool
+
+	JWKSTrusted     bool
+	CertPoolTrusted bool
+
+	ExtraJWKSURIs []*url.URL
+	ExtraCertPool *x509.CertPool
 
 	Logger logrus.FieldLogger
 
 	OnFirstClaims func(*Server)
+
+	// OnStatus is called with a short status summary whenever it changes.
+	OnStatus func(*Server, string)
+
+	// OnReload is called when a reload is triggered by signal, with done
+	// false before and true after the reload.
+	OnReload func(*Server, bool)
 }
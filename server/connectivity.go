@@ -0,0 +1,108 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"time"
+
+	api "stash.kopano.io/kgol/kustomer/server/api-v1"
+)
+
+// Online states of the server, tracking the JWKS connectivity.
+const (
+	onlineStateNeverOnline = "never-online"
+	onlineStateOnline      = "online"
+	onlineStateDegraded    = "degraded"
+	onlineStateOffline     = "offline"
+)
+
+// A connectivity is the state machine tracking if the server is online.
+//
+//	never-online --success--> online --failure--> degraded --failures--> offline
+//
+// Any success transitions to online. Failures only transition to offline once
+// threshold consecutive failures are reached.
+type connectivity struct {
+	threshold uint
+
+	state       string
+	failures    uint
+	since       time.Time
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+// newConnectivity returns a new connectivity in never-online state with the
+// provided threshold of consecutive failures to become offline.
+func newConnectivity(threshold uint, now time.Time) *connectivity {
+	return &connectivity{
+		threshold: threshold,
+
+		state: onlineStateNeverOnline,
+		since: now,
+	}
+}
+
+// record records a success or failure at the provided time and returns the
+// previous state if the state has changed, empty string otherwise.
+func (c *connectivity) record(success bool, now time.Time) string {
+	next := c.state
+	if success {
+		c.failures = 0
+		c.lastSuccess = now
+		next = onlineStateOnline
+	} else {
+		c.failures++
+		c.lastFailure = now
+		switch c.state {
+		case onlineStateOnline, onlineStateDegraded:
+			if c.failures >= c.threshold {
+				next = onlineStateOffline
+			} else {
+				next = onlineStateDegraded
+			}
+		}
+	}
+
+	if next == c.state {
+		return ""
+	}
+	previous := c.state
+	c.state = next
+	c.since = now
+	return previous
+}
+
+// online returns true if the associated connectivity is online, means keys
+// which require being online can be used.
+func (c *connectivity) online() bool {
+	return c.state == onlineStateOnline
+}
+
+// offline returns true if the associated connectivity is offline or was never
+// online. Degraded is not offline. This matches the former failure counter,
+// which started at the threshold and thus reported offline until the first
+// success.
+func (c *connectivity) offline() bool {
+	return c.state == onlineStateOffline || c.state == onlineStateNeverOnline
+}
+
+// response returns the API response model of the associated connectivity.
+func (c *connectivity) response() *api.ConnectivityResponse {
+	r := &api.ConnectivityResponse{
+		State:    c.state,
+		Offline:  c.offline(),
+		Failures: c.failures,
+		Since:    c.since.Unix(),
+	}
+	if !c.lastSuccess.IsZero() {
+		r.LastSuccess = c.lastSuccess.Unix()
+	}
+	if !c.lastFailure.IsZero() {
+		r.LastFailure = c.lastFailure.Unix()
+	}
+	return r
+}
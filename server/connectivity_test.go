@@ -0,0 +1,89 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectivityRecord(t *testing.T) {
+	type step struct {
+		success  bool
+		state    string
+		previous string
+		offline  bool
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{"never online failures", []step{
+			{false, onlineStateNeverOnline, "", true},
+			{false, onlineStateNeverOnline, "", true},
+			{false, onlineStateNeverOnline, "", true},
+			{false, onlineStateNeverOnline, "", true},
+		}},
+		{"first success", []step{
+			{false, onlineStateNeverOnline, "", true},
+			{true, onlineStateOnline, onlineStateNeverOnline, false},
+			{true, onlineStateOnline, "", false},
+		}},
+		{"degraded below threshold", []step{
+			{true, onlineStateOnline, onlineStateNeverOnline, false},
+			{false, onlineStateDegraded, onlineStateOnline, false},
+			{false, onlineStateDegraded, "", false},
+			{true, onlineStateOnline, onlineStateDegraded, false},
+		}},
+		{"offline at threshold", []step{
+			{true, onlineStateOnline, onlineStateNeverOnline, false},
+			{false, onlineStateDegraded, onlineStateOnline, false},
+			{false, onlineStateDegraded, "", false},
+			{false, onlineStateOffline, onlineStateDegraded, true},
+			{false, onlineStateOffline, "", true},
+			{true, onlineStateOnline, onlineStateOffline, false},
+		}},
+		{"success resets failures", []step{
+			{true, onlineStateOnline, onlineStateNeverOnline, false},
+			{false, onlineStateDegraded, onlineStateOnline, false},
+			{false, onlineStateDegraded, "", false},
+			{true, onlineStateOnline, onlineStateDegraded, false},
+			{false, onlineStateDegraded, onlineStateOnline, false},
+			{false, onlineStateDegraded, "", false},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Unix(1000, 0)
+			c := newConnectivity(3, now)
+			if !c.offline() || c.online() {
+				t.Fatalf("expected new connectivity to be offline")
+			}
+			for idx, step := range tc.steps {
+				now = now.Add(time.Minute)
+				previous := c.record(step.success, now)
+				if previous != step.previous {
+					t.Errorf("step %d: expected previous %q, got %q", idx, step.previous, previous)
+				}
+				if c.state != step.state {
+					t.Errorf("step %d: expected state %s, got %s", idx, step.state, c.state)
+				}
+				if c.offline() != step.offline {
+					t.Errorf("step %d: expected offline %v, got %v", idx, step.offline, c.offline())
+				}
+				if c.online() != (step.state == onlineStateOnline) {
+					t.Errorf("step %d: unexpected online %v", idx, c.online())
+				}
+				if previous != "" && !c.since.Equal(now) {
+					t.Errorf("step %d: expected since to be updated on transition", idx)
+				}
+				response := c.response()
+				if response.State != c.state || response.Offline != c.offline() || response.Failures != c.failures {
+					t.Errorf("step %d: response does not match state: %+v", idx, response)
+				}
+			}
+		})
+	}
+}
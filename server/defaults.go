@@ -8,4 +8,7 @@ package server
 var (
 	DefaultLicenseJWKSURI     = "" // Set on build.
 	DefaultLicenseCertsBase64 = "" // Set on build.
+	DefaultLicenseIssuer      = "" // Set on build.
+	DefaultLicenseAudience    = "" // Set on build, comma separated.
+	DefaultLicenseJWKSSigned  = "" // Set on build, yes to require signed JWKS.
 )
@@ -0,0 +1,62 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"encoding/json"
+)
+
+const eventQueueSize = 16
+
+// An event is a claims related event which is sent to claims watchers.
+type event struct {
+	name string
+	data string
+}
+
+// subscribe registers a new event channel with the associated server. The
+// returned channel receives all events until unsubscribe is called with it.
+func (s *Server) subscribe() chan *event {
+	ch := make(chan *event, eventQueueSize)
+
+	s.mutex.Lock()
+	s.watchers[ch] = struct{}{}
+	s.mutex.Unlock()
+
+	return ch
+}
+
+// unsubscribe removes the provided event channel from the associated server.
+func (s *Server) unsubscribe(ch chan *event) {
+	s.mutex.Lock()
+	delete(s.watchers, ch)
+	s.mutex.Unlock()
+}
+
+// notify sends an event with the provided name and the JSON encoded data to
+// all subscribed event channels. Events are dropped for channels which are
+// full.
+func (s *Server) notify(name string, data interface{}) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		s.logger.WithError(err).WithField("event", name).Errorln("failed to encode event data")
+		return
+	}
+	e := &event{
+		name: name,
+		data: string(encoded),
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for ch := range s.watchers {
+		select {
+		case ch <- e:
+		default:
+			s.logger.WithField("event", name).Debugln("event queue full, event dropped")
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
@@ -26,6 +27,71 @@ func (s *Server) HealthCheckHandler(rw http.ResponseWriter, req *http.Request) {
 	rw.WriteHeader(http.StatusOK)
 }
 
+// HealthLiveHandler is a http handler returning the health of the associated
+// server as JSON. Returns 200 OK when the license scanning is not stuck.
+func (s *Server) HealthLiveHandler(rw http.ResponseWriter, req *http.Request) {
+	response := s.Health()
+	status := http.StatusOK
+	if !response.Live {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeHealthResponse(rw, status, response)
+}
+
+// HealthReadyHandler is a http handler returning the health of the associated
+// server as JSON. Returns 200 OK when licenses were scanned and the license
+// scanning is not stuck.
+func (s *Server) HealthReadyHandler(rw http.ResponseWriter, req *http.Request) {
+	response := s.Health()
+	status := http.StatusOK
+	if !response.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeHealthResponse(rw, status, response)
+}
+
+// Health returns the current health of the associated server.
+func (s *Server) Health() *api.HealthResponse {
+	var ready bool
+	select {
+	case <-s.readyCh:
+		ready = true
+	default:
+	}
+
+	s.mutex.RLock()
+	heartbeat := s.heartbeat
+	lastScan := s.lastScan
+	response := &api.HealthResponse{
+		Connectivity: s.connectivity.response(),
+	}
+	s.mutex.RUnlock()
+
+	// Not started scanning yet is live, it waits for the JWKS.
+	response.Live = heartbeat.IsZero() || time.Since(heartbeat) < healthHeartbeatTimeout
+	response.Ready = ready && response.Live
+	if !heartbeat.IsZero() {
+		response.Heartbeat = heartbeat.Unix()
+	}
+	if !lastScan.IsZero() {
+		response.LastScan = lastScan.Unix()
+	}
+	return response
+}
+
+func (s *Server) writeHealthResponse(rw http.ResponseWriter, status int, response *api.HealthResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.WriteHeader(status)
+
+	encoder := json.NewEncoder(rw)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(response)
+	if err != nil {
+		s.logger.WithError(err).Errorln("failed to encode health response")
+	}
+}
+
 // ReloadHandler is a http handler which triggers reloading of license files and
 // returns when complete.
 func (s *Server) ReloadHandler(rw http.ResponseWriter, req *http.Request) {
@@ -46,16 +112,14 @@ func (s *Server) ReloadHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	fields := logrus.Fields{
-		"remote_uid":  ucred.Uid,
-		"ua":          req.Header.Get("User-Agent"),
-		"remote_addr": req.RemoteAddr,
-	}
+	fields := requestLogFields(req)
 	if ucred.Uid != 0 {
+		s.auditRequest(auditEventReloadRejected, req)
 		s.logger.WithFields(fields).Debugln("rejected reload request")
 		http.Error(rw, "reload request must be sent as root", http.StatusForbidden)
 		return
 	}
+	s.auditRequest(auditEventReload, req)
 	s.logger.WithFields(fields).Infoln("received reload request")
 
 	// Trigger reload with callback channel.
@@ -117,11 +181,24 @@ func (s *Server) ClaimsHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	s.auditRequest(auditEventClaimsRead, req)
+
 	s.mutex.RLock()
 	claims := s.claims
 	s.mutex.RUnlock()
 
-	response := api.ClaimsResponse(claims)
+	response := make(api.ClaimsResponse, 0, len(claims))
+	for _, claim := range claims {
+		response = append(response, &api.ClaimsResponseLicense{
+			Claims: claim,
+			Name:   claim.LicenseFileName,
+			Source: claim.LicenseSource,
+			Grace:  !claim.GraceUntil.IsZero(),
+
+			Trusted:   claim.KeyTrusted,
+			KeySource: claim.KeySource,
+		})
+	}
 
 	rw.Header().Set("Content-Type", "application/json")
 
@@ -151,15 +228,8 @@ func (s *Server) ClaimsKopanoProductsHandler(rw http.ResponseWriter, req *http.R
 	}
 
 	func() {
-		fields := logrus.Fields{
-			"products":    req.Form["product"],
-			"ua":          req.Header.Get("User-Agent"),
-			"remote_addr": req.RemoteAddr,
-		}
-		if ucred, ok := GetUcredContextValue(req.Context()); ok {
-			fields["remote_pid"] = ucred.Pid
-			fields["remote_uid"] = ucred.Uid
-		}
+		fields := requestLogFields(req)
+		fields["products"] = req.Form["product"]
 		s.logger.WithFields(fields).Debugln("received claims kopano products request")
 	}()
 
@@ -179,16 +249,73 @@ func (s *Server) ClaimsKopanoProductsHandler(rw http.ResponseWriter, req *http.R
 	s.mutex.RLock()
 	claims := s.claims
 	trusted := s.trusted
-	offline := s.offline
-	offlineThreshold := s.offlineThreshold
+	connectivity := s.connectivity.response()
 	s.mutex.RUnlock()
 
 	response := &api.ClaimsKopanoProductsResponse{
 		Trusted:  trusted,
-		Offline:  offline >= offlineThreshold,
-		Products: make(map[string]*api.ClaimsKopanoProductsResponseProduct),
+		Offline:  connectivity.Offline,
+		Products: s.kopanoProducts(claims, productFilter),
+
+		Connectivity: connectivity,
+	}
+	rw.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(rw)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(response)
+	if err != nil {
+		s.logger.WithField("request_path", req.URL.Path).WithError(err).Errorln("failed to encode JSON")
+	}
+}
+
+// HistoryHandler is the http handler to return the recorded history of the
+// effective claims, optionally limited by the since and until Unix timestamps
+// in seconds.
+func (s *Server) HistoryHandler(rw http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(rw, "failed to parse request form data", http.StatusBadRequest)
+		return
 	}
-	products := response.Products
+
+	var since, until int64
+	if v := req.Form.Get("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(rw, "invalid since value", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := req.Form.Get("until"); v != "" {
+		if until, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(rw, "invalid until value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := s.history.entries(since, until)
+	if err != nil {
+		s.logger.WithError(err).Errorln("failed to read license history")
+		http.Error(rw, "failed to read license history", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(rw)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(&api.HistoryResponse{
+		Entries: entries,
+	})
+	if err != nil {
+		s.logger.WithField("request_path", req.URL.Path).WithError(err).Errorln("failed to encode JSON")
+	}
+}
+
+// kopanoProducts aggregates the Kopano product data of the provided claims,
+// optionally limited to the products in the provided filter.
+func (s *Server) kopanoProducts(claims []*license.Claims, productFilter map[string]bool) map[string]*api.ClaimsKopanoProductsResponseProduct {
+	products := make(map[string]*api.ClaimsKopanoProductsResponseProduct)
 	for _, claim := range claims {
 		if claim.Kopano.Products == nil {
 			continue
@@ -208,6 +335,7 @@ func (s *Server) ClaimsKopanoProductsHandler(rw http.ResponseWriter, req *http.R
 			if !ok {
 				entry = &api.ClaimsKopanoProductsResponseProduct{
 					OK:                          true,
+					Trusted:                     true,
 					Claims:                      make(map[string]interface{}),
 					Expiry:                      make([]*jwt.NumericDate, 0),
 					DisplayName:                 make([]string, 0),
@@ -237,7 +365,7 @@ func (s *Server) ClaimsKopanoProductsHandler(rw http.ResponseWriter, req *http.R
 				if exclusiveValue, exclusive := entry.ExclusiveClaims[k]; exclusive {
 					// Check for existing exclusive claims, violating our new value.
 					if nextValue != exclusiveValue {
-						logger.Warnf("conflict of exclusive claim %s, any older license with a conflicting value of this claim must be removed before this license can be used")
+						logger.Warnf("conflict of exclusive claim %s, any older license with a conflicting value of this claim must be removed before this license can be used", k)
 						aggregate = false
 					}
 					continue
@@ -314,6 +442,21 @@ func (s *Server) ClaimsKopanoProductsHandler(rw http.ResponseWriter, req *http.R
 				}
 			}
 			entry.Expiry = append(entry.Expiry, claim.Expiry)
+			if !claim.KeyTrusted {
+				// A product is only trusted if all its licenses are.
+				entry.Trusted = false
+			}
+			if !claim.GraceUntil.IsZero() {
+				// Report the shortest remaining grace time of all licenses.
+				remaining := int64(time.Until(claim.GraceUntil).Seconds())
+				if remaining < 0 {
+					remaining = 0
+				}
+				if !entry.Grace || remaining < entry.GraceRemaining {
+					entry.GraceRemaining = remaining
+				}
+				entry.Grace = true
+			}
 			if claim.DisplayName != "" {
 				entry.DisplayName = appendIfMissingS(entry.DisplayName, claim.DisplayName)
 			}
@@ -329,14 +472,7 @@ func (s *Server) ClaimsKopanoProductsHandler(rw http.ResponseWriter, req *http.R
 		}
 	}
 
-	rw.Header().Set("Content-Type", "application/json")
-
-	encoder := json.NewEncoder(rw)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(response)
-	if err != nil {
-		s.logger.WithField("request_path", req.URL.Path).WithError(err).Errorln("failed to encode JSON")
-	}
+	return products
 }
 
 // MakeClaimsWatchHandler return a http handler which returns claims related
@@ -367,13 +503,9 @@ func (s *Server) MakeClaimsWatchHandler() http.HandlerFunc {
 
 		start := time.Now()
 
-		fields := logrus.Fields{
-			"products":    req.Form["product"],
-			"remote_uid":  ucred.Uid,
-			"remote_pid":  ucred.Pid,
-			"ua":          req.Header.Get("User-Agent"),
-			"remote_addr": req.RemoteAddr,
-		}
+		fields := requestLogFields(req)
+		fields["products"] = req.Form["product"]
+		s.auditRequest(auditEventClaimsRead, req)
 		s.logger.WithFields(fields).Infoln("claims watch started")
 		defer func() {
 			s.logger.WithFields(fields).WithField("duration", time.Since(start)).Infoln("claims watch ended")
@@ -386,6 +518,9 @@ func (s *Server) MakeClaimsWatchHandler() http.HandlerFunc {
 			return
 		}
 
+		eventCh := s.subscribe()
+		defer s.unsubscribe(eventCh)
+
 		// Block until request is done, or other action worty to send event.
 		for {
 			err = nil
@@ -400,6 +535,8 @@ func (s *Server) MakeClaimsWatchHandler() http.HandlerFunc {
 				return
 			case <-updateCh:
 				err = conn.WriteStringEvent("claims-updated", "true")
+			case e := <-eventCh:
+				err = conn.WriteStringEvent(e.name, e.data)
 			case <-time.After(60 * time.Second):
 				err = conn.WriteStringEvent("hello", version)
 			}
@@ -411,3 +548,34 @@ func (s *Server) MakeClaimsWatchHandler() http.HandlerFunc {
 		}
 	}
 }
+
+// requestLogFields returns the log fields identifying the client of the
+// provided request, including its unix credentials if available.
+func requestLogFields(req *http.Request) logrus.Fields {
+	fields := logrus.Fields{
+		"ua":          req.Header.Get("User-Agent"),
+		"remote_addr": req.RemoteAddr,
+	}
+	if ucred, ok := GetUcredContextValue(req.Context()); ok {
+		fields["remote_uid"] = ucred.Uid
+		fields["remote_pid"] = ucred.Pid
+	}
+	return fields
+}
+
+// auditRequest records the provided event for the provided request in the
+// audit log, identifying the requesting local process.
+func (s *Server) auditRequest(event string, req *http.Request) {
+	if s.audit == nil {
+		return
+	}
+	r := &auditRecord{
+		Event:  event,
+		Path:   req.URL.Path,
+		Remote: newAuditRemote(req),
+	}
+	if event == auditEventReload || event == auditEventReloadRejected {
+		r.Trigger = "api"
+	}
+	s.audit.record(r)
+}
@@ -0,0 +1,82 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api "stash.kopano.io/kgol/kustomer/server/api-v1"
+)
+
+func TestHealth(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name      string
+		ready     bool
+		heartbeat time.Time
+		live      bool
+	}{
+		{"starting", false, time.Time{}, true},
+		{"waiting for first scan", false, now, true},
+		{"ready", true, now, true},
+		{"ready without heartbeat", true, time.Time{}, true},
+		{"stale heartbeat", true, now.Add(-2 * healthHeartbeatTimeout), false},
+		{"stale heartbeat not ready", false, now.Add(-2 * healthHeartbeatTimeout), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				logger:       newTestLogger(),
+				connectivity: newConnectivity(offlineThreshold, now),
+				readyCh:      make(chan struct{}),
+				heartbeat:    tc.heartbeat,
+			}
+			if tc.ready {
+				close(s.readyCh)
+			}
+
+			response := s.Health()
+			if response.Live != tc.live {
+				t.Errorf("expected live %v, got %v", tc.live, response.Live)
+			}
+			if expected := tc.ready && tc.live; response.Ready != expected {
+				t.Errorf("expected ready %v, got %v", expected, response.Ready)
+			}
+			if response.Connectivity == nil {
+				t.Errorf("expected connectivity in response")
+			}
+
+			for _, handler := range []struct {
+				name string
+				f    http.HandlerFunc
+				ok   bool
+			}{
+				{"live", s.HealthLiveHandler, tc.live},
+				{"ready", s.HealthReadyHandler, tc.ready && tc.live},
+			} {
+				rec := httptest.NewRecorder()
+				handler.f(rec, httptest.NewRequest(http.MethodGet, "/health/"+handler.name, nil))
+				expected := http.StatusOK
+				if !handler.ok {
+					expected = http.StatusServiceUnavailable
+				}
+				if rec.Code != expected {
+					t.Errorf("%s: expected status %d, got %d", handler.name, expected, rec.Code)
+				}
+				decoded := &api.HealthResponse{}
+				if err := json.NewDecoder(rec.Body).Decode(decoded); err != nil {
+					t.Fatalf("%s: invalid response: %v", handler.name, err)
+				}
+				if decoded.Live != response.Live || decoded.Ready != response.Ready {
+					t.Errorf("%s: response does not match health: %+v", handler.name, decoded)
+				}
+			}
+		})
+	}
+}
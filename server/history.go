@@ -0,0 +1,295 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kgol/kustomer/license"
+	api "stash.kopano.io/kgol/kustomer/server/api-v1"
+)
+
+const historyFileName = "history.jsonl"
+
+// Triggers of license scans, recorded in the history.
+const (
+	scanTriggerStartup      = "startup"
+	scanTriggerInterval     = "interval"
+	scanTriggerReload       = "reload"
+	scanTriggerKeys         = "keys"
+	scanTriggerConnectivity = "connectivity"
+	scanTriggerRevocations  = "revocations"
+	scanTriggerFetch        = "fetch"
+)
+
+// historyLineSizeLimitBytes is the maximum size of a single history entry.
+const historyLineSizeLimitBytes = 1024 * 1024 * 4
+
+// historyCompactInterval is the minimal interval between removing entries
+// older than the retention from the history.
+const historyCompactInterval = 24 * time.Hour
+
+// DefaultHistoryRetention is the default duration history entries are kept.
+const DefaultHistoryRetention = 365 * 24 * time.Hour
+
+// A historyStore persists snapshots of the effective claims whenever they
+// change, one JSON entry per line appended to a file in the state path.
+// Entries older than the retention are removed, but the last entry is always
+// kept as base for the next change.
+type historyStore struct {
+	mutex sync.Mutex
+
+	path      string
+	retention time.Duration
+
+	last        *api.HistoryEntry
+	lastCompact time.Time
+}
+
+// load loads the last entry of the associated history, if there is any, and
+// removes entries older than the retention at the provided time.
+func (h *historyStore) load(now time.Time, logger logrus.FieldLogger) {
+	if h.path == "" {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	err := h.read(func(entry *api.HistoryEntry) {
+		h.last = entry
+	})
+	if err != nil && !os.IsNotExist(err) {
+		logger.WithError(err).Warnln("failed to read license history")
+		return
+	}
+	h.compact(now, logger)
+}
+
+// read calls the provided function for each entry of the associated history,
+// in the order they were recorded. The caller is responsible to hold the lock.
+func (h *historyStore) read(f func(*api.HistoryEntry)) error {
+	file, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return readHistory(file, f)
+}
+
+// readHistory calls the provided function for each entry read from the
+// provided reader.
+func readHistory(r io.Reader, f func(*api.HistoryEntry)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, historyLineSizeLimitBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		entry := &api.HistoryEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			// Skip broken entries, for example a partial write.
+			continue
+		}
+		f(entry)
+	}
+	return scanner.Err()
+}
+
+// record appends a snapshot of the provided claims and products to the
+// associated history if they differ from the last entry. Returns true if an
+// entry was recorded.
+func (h *historyStore) record(claims []*license.Claims, products map[string]*api.ClaimsKopanoProductsResponseProduct, trigger string, now time.Time, logger logrus.FieldLogger) bool {
+	entry := &api.HistoryEntry{
+		Time:     now.Unix(),
+		Trigger:  trigger,
+		Added:    []string{},
+		Removed:  []string{},
+		Licenses: []string{},
+		Products: products,
+	}
+	current := make(map[string]bool)
+	for _, c := range claims {
+		if c.LicenseID == "" {
+			// Ignore the global configured sub.
+			continue
+		}
+		entry.Licenses = appendIfMissingS(entry.Licenses, c.LicenseID)
+		current[c.LicenseID] = true
+	}
+	sort.Strings(entry.Licenses)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	previous := make(map[string]bool)
+	if h.last != nil {
+		if historyEntryEqual(h.last, entry) {
+			return false
+		}
+		for _, id := range h.last.Licenses {
+			previous[id] = true
+			if !current[id] {
+				entry.Removed = append(entry.Removed, id)
+			}
+		}
+	}
+	for _, id := range entry.Licenses {
+		if !previous[id] {
+			entry.Added = append(entry.Added, id)
+		}
+	}
+	h.last = entry
+
+	if h.path == "" {
+		return true
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = appendFile(h.path, append(data, '\n'), 0600)
+	}
+	if err != nil {
+		logger.WithError(err).Warnln("failed to write license history")
+	}
+	if now.Sub(h.lastCompact) >= historyCompactInterval {
+		h.compact(now, logger)
+	}
+	return true
+}
+
+// compact rewrites the associated history without the entries which are older
+// than the retention at the provided time. The caller is responsible to hold
+// the lock.
+func (h *historyStore) compact(now time.Time, logger logrus.FieldLogger) {
+	h.lastCompact = now
+	if h.retention <= 0 {
+		return
+	}
+
+	cutoff := now.Add(-h.retention).Unix()
+	var kept []*api.HistoryEntry
+	var removed int
+	err := h.read(func(entry *api.HistoryEntry) {
+		if entry.Time < cutoff {
+			removed++
+			return
+		}
+		kept = append(kept, entry)
+	})
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.WithError(err).Warnln("failed to read license history")
+		}
+		return
+	}
+	if removed == 0 {
+		return
+	}
+	if len(kept) == 0 && h.last != nil {
+		// Always keep the last entry.
+		kept = append(kept, h.last)
+		removed--
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range kept {
+		if err = encoder.Encode(entry); err != nil {
+			logger.WithError(err).Warnln("failed to encode license history")
+			return
+		}
+	}
+	// Replace the file, so readers keep reading their open file.
+	if err = writeFileAtomic(h.path, buf.Bytes(), 0600); err != nil {
+		logger.WithError(err).Warnln("failed to write license history")
+		return
+	}
+	logger.WithField("count", removed).Debugln("expired license history entries removed")
+}
+
+// entries returns all entries of the associated history which were recorded
+// in the provided time range of Unix timestamps in seconds. Zero means no
+// limit. The history is read without holding the lock, up to its size when
+// this is called.
+func (h *historyStore) entries(since, until int64) ([]*api.HistoryEntry, error) {
+	entries := make([]*api.HistoryEntry, 0)
+	if h.path == "" {
+		return entries, nil
+	}
+
+	h.mutex.Lock()
+	file, err := os.Open(h.path)
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		if info, err = file.Stat(); err == nil {
+			size = info.Size()
+		} else {
+			file.Close()
+		}
+	}
+	h.mutex.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	err = readHistory(io.LimitReader(file, size), func(entry *api.HistoryEntry) {
+		if since > 0 && entry.Time < since {
+			return
+		}
+		if until > 0 && entry.Time > until {
+			return
+		}
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// historyEntryEqual returns true if the provided entries have the same
+// licenses and effective product claims. The remaining grace time changes
+// constantly and is ignored.
+func historyEntryEqual(a, b *api.HistoryEntry) bool {
+	if len(a.Licenses) != len(b.Licenses) {
+		return false
+	}
+	for idx, id := range a.Licenses {
+		if b.Licenses[idx] != id {
+			return false
+		}
+	}
+
+	normalize := func(products map[string]*api.ClaimsKopanoProductsResponseProduct) []byte {
+		normalized := make(map[string]api.ClaimsKopanoProductsResponseProduct, len(products))
+		for name, product := range products {
+			p := *product
+			p.GraceRemaining = 0
+			normalized[name] = p
+		}
+		// Map keys are sorted when encoding, and decoded entries encode the
+		// same, so the results can be compared.
+		data, _ := json.Marshal(normalized)
+		return data
+	}
+	return bytes.Equal(normalize(a.Products), normalize(b.Products))
+}
@@ -0,0 +1,272 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"stash.kopano.io/kgol/kustomer/license"
+	api "stash.kopano.io/kgol/kustomer/server/api-v1"
+)
+
+func newTestHistoryStore(t *testing.T, retention time.Duration) (*historyStore, func()) {
+	dir, err := ioutil.TempDir("", "kustomer-history-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &historyStore{
+		path:      filepath.Join(dir, historyFileName),
+		retention: retention,
+	}
+	return h, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestHistoryClaims(ids ...string) []*license.Claims {
+	claims := make([]*license.Claims, 0, len(ids))
+	for _, id := range ids {
+		claims = append(claims, &license.Claims{
+			LicenseID: id,
+		})
+	}
+	return claims
+}
+
+func newTestHistoryProducts(users int64, grace bool, graceRemaining int64) map[string]*api.ClaimsKopanoProductsResponseProduct {
+	return map[string]*api.ClaimsKopanoProductsResponseProduct{
+		"groupware": {
+			OK: true,
+			Claims: map[string]interface{}{
+				"users": users,
+			},
+			Grace:          grace,
+			GraceRemaining: graceRemaining,
+		},
+	}
+}
+
+func TestHistoryEntryEqual(t *testing.T) {
+	decoded := &api.HistoryEntry{}
+	data, err := json.Marshal(&api.HistoryEntry{
+		Licenses: []string{"a"},
+		Products: newTestHistoryProducts(10, false, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		a     *api.HistoryEntry
+		b     *api.HistoryEntry
+		equal bool
+	}{
+		{
+			"same",
+			&api.HistoryEntry{Licenses: []string{"a", "b"}, Products: newTestHistoryProducts(10, false, 0)},
+			&api.HistoryEntry{Licenses: []string{"a", "b"}, Products: newTestHistoryProducts(10, false, 0)},
+			true,
+		},
+		{
+			"time and trigger ignored",
+			&api.HistoryEntry{Time: 1, Trigger: scanTriggerStartup, Licenses: []string{"a"}, Products: newTestHistoryProducts(10, false, 0)},
+			&api.HistoryEntry{Time: 2, Trigger: scanTriggerInterval, Licenses: []string{"a"}, Products: newTestHistoryProducts(10, false, 0)},
+			true,
+		},
+		{
+			"grace remaining ignored",
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(10, true, 3600)},
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(10, true, 60)},
+			true,
+		},
+		{
+			"decoded",
+			decoded,
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(10, false, 0)},
+			true,
+		},
+		{
+			"grace",
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(10, false, 0)},
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(10, true, 60)},
+			false,
+		},
+		{
+			"claims",
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(10, false, 0)},
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(20, false, 0)},
+			false,
+		},
+		{
+			"licenses",
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(10, false, 0)},
+			&api.HistoryEntry{Licenses: []string{"b"}, Products: newTestHistoryProducts(10, false, 0)},
+			false,
+		},
+		{
+			"license count",
+			&api.HistoryEntry{Licenses: []string{"a"}, Products: newTestHistoryProducts(10, false, 0)},
+			&api.HistoryEntry{Licenses: []string{"a", "b"}, Products: newTestHistoryProducts(10, false, 0)},
+			false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if equal := historyEntryEqual(tc.a, tc.b); equal != tc.equal {
+				t.Errorf("expected equal %v, got %v", tc.equal, equal)
+			}
+		})
+	}
+}
+
+func TestHistoryStoreRecord(t *testing.T) {
+	h, cleanup := newTestHistoryStore(t, 0)
+	defer cleanup()
+	logger := newTestLogger()
+	now := time.Unix(1000000, 0)
+
+	for idx, step := range []struct {
+		claims   []*license.Claims
+		users    int64
+		recorded bool
+		added    []string
+		removed  []string
+	}{
+		{newTestHistoryClaims(), 0, true, []string{}, []string{}},
+		{newTestHistoryClaims("a"), 10, true, []string{"a"}, []string{}},
+		{newTestHistoryClaims("a"), 10, false, nil, nil},
+		{newTestHistoryClaims("b", "a", ""), 15, true, []string{"b"}, []string{}},
+		{newTestHistoryClaims("c", "b"), 15, true, []string{"c"}, []string{"a"}},
+		{newTestHistoryClaims("c", "b"), 20, true, []string{}, []string{}},
+		{newTestHistoryClaims(), 0, true, []string{}, []string{"b", "c"}},
+	} {
+		now = now.Add(time.Minute)
+		recorded := h.record(step.claims, newTestHistoryProducts(step.users, false, 0), scanTriggerInterval, now, logger)
+		if recorded != step.recorded {
+			t.Fatalf("step %d: expected recorded %v, got %v", idx, step.recorded, recorded)
+		}
+		if !recorded {
+			continue
+		}
+		if !reflect.DeepEqual(h.last.Added, step.added) {
+			t.Errorf("step %d: expected added %v, got %v", idx, step.added, h.last.Added)
+		}
+		if !reflect.DeepEqual(h.last.Removed, step.removed) {
+			t.Errorf("step %d: expected removed %v, got %v", idx, step.removed, h.last.Removed)
+		}
+	}
+
+	entries, err := h.entries(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 persisted entries, got %d", len(entries))
+	}
+
+	// A restart compares with the last persisted entry.
+	reloaded := &historyStore{
+		path: h.path,
+	}
+	reloaded.load(now, logger)
+	if reloaded.record(newTestHistoryClaims(), newTestHistoryProducts(0, false, 0), scanTriggerStartup, now.Add(time.Minute), logger) {
+		t.Errorf("expected unchanged claims not to be recorded after load")
+	}
+	if !reloaded.record(newTestHistoryClaims("a"), newTestHistoryProducts(10, false, 0), scanTriggerStartup, now.Add(time.Minute), logger) {
+		t.Errorf("expected changed claims to be recorded after load")
+	}
+}
+
+func TestHistoryStoreEntries(t *testing.T) {
+	h, cleanup := newTestHistoryStore(t, 0)
+	defer cleanup()
+	logger := newTestLogger()
+
+	for idx, ts := range []int64{100, 200, 300, 400} {
+		h.record(newTestHistoryClaims(), newTestHistoryProducts(int64(idx), false, 0), scanTriggerInterval, time.Unix(ts, 0), logger)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		since    int64
+		until    int64
+		expected []int64
+	}{
+		{"all", 0, 0, []int64{100, 200, 300, 400}},
+		{"since", 200, 0, []int64{200, 300, 400}},
+		{"until", 0, 300, []int64{100, 200, 300}},
+		{"range", 150, 350, []int64{200, 300}},
+		{"empty range", 410, 0, []int64{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := h.entries(tc.since, tc.until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			times := make([]int64, 0, len(entries))
+			for _, entry := range entries {
+				times = append(times, entry.Time)
+			}
+			if !reflect.DeepEqual(times, tc.expected) {
+				t.Errorf("expected entries at %v, got %v", tc.expected, times)
+			}
+		})
+	}
+
+	empty := &historyStore{
+		path: h.path + ".missing",
+	}
+	if entries, err := empty.entries(0, 0); err != nil || len(entries) != 0 {
+		t.Errorf("expected no entries for missing history, got %v %v", entries, err)
+	}
+}
+
+func TestHistoryStoreRetention(t *testing.T) {
+	h, cleanup := newTestHistoryStore(t, time.Hour)
+	defer cleanup()
+	logger := newTestLogger()
+	start := time.Unix(1000000, 0)
+
+	h.record(newTestHistoryClaims("a"), newTestHistoryProducts(1, false, 0), scanTriggerInterval, start, logger)
+	h.record(newTestHistoryClaims("b"), newTestHistoryProducts(2, false, 0), scanTriggerInterval, start.Add(time.Minute), logger)
+
+	// All entries expired, the last is kept as base for the next change.
+	reloaded := &historyStore{
+		path:      h.path,
+		retention: time.Hour,
+	}
+	reloaded.load(start.Add(2*time.Hour), logger)
+	entries, err := reloaded.entries(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Licenses[0] != "b" {
+		t.Fatalf("expected only the last entry to be kept, got %v", entries)
+	}
+
+	// Compaction runs with a record after the compact interval.
+	reloaded.record(newTestHistoryClaims("c"), newTestHistoryProducts(3, false, 0), scanTriggerInterval, start.Add(3*time.Hour), logger)
+	reloaded.record(newTestHistoryClaims("d"), newTestHistoryProducts(4, false, 0), scanTriggerInterval, start.Add(historyCompactInterval+4*time.Hour), logger)
+	entries, err = reloaded.entries(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Licenses[0] != "d" {
+		t.Fatalf("expected expired entries to be removed, got %v", entries)
+	}
+	if entries[0].Removed[0] != "c" {
+		t.Errorf("expected last entry to be based on the previous one, got %v", entries[0].Removed)
+	}
+}
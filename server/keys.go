@@ -0,0 +1,165 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const jwksHistoryFileName = "jwks-history.json"
+
+// A retiredKey is a key which was removed from the JWKS.
+type retiredKey struct {
+	Key       jose.JSONWebKey `json:"key"`
+	RetiredAt time.Time       `json:"retired_at"`
+}
+
+// A jwksHistory tracks the keys of the JWKS, to keep accepting keys which were
+// removed for an overlap window.
+type jwksHistory struct {
+	path    string
+	overlap time.Duration
+
+	Current []jose.JSONWebKey `json:"current"`
+	Retired []*retiredKey     `json:"retired"`
+}
+
+// load loads the history from the associated file, if there is any.
+func (h *jwksHistory) load(logger logrus.FieldLogger) {
+	if h.path == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.WithError(err).Warnln("failed to read JWKS history")
+		}
+		return
+	}
+	if err = json.Unmarshal(data, h); err != nil {
+		logger.WithError(err).Warnln("failed to parse JWKS history")
+		h.Current = nil
+		h.Retired = nil
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"current": len(h.Current),
+		"retired": len(h.Retired),
+	}).Debugln("JWKS history loaded")
+}
+
+// save writes the history to the associated file, if it has a path.
+func (h *jwksHistory) save(logger logrus.FieldLogger) {
+	if h.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(h)
+	if err == nil {
+		err = writeFileAtomic(h.path, data, 0600)
+	}
+	if err != nil {
+		logger.WithError(err).Warnln("failed to write JWKS history")
+	}
+}
+
+// update replaces the current keys of the associated history with the keys of
+// the provided JWKS. Keys which are no longer in the JWKS are retired at the
+// provided time. Returns true if the retired keys have changed.
+func (h *jwksHistory) update(jwks *jose.JSONWebKeySet, now time.Time, logger logrus.FieldLogger) bool {
+	next := make(map[string]bool)
+	for _, key := range jwks.Keys {
+		next[keyThumbprint(key)] = true
+	}
+
+	var changed bool
+	retired := make([]*retiredKey, 0, len(h.Retired))
+	for _, r := range h.Retired {
+		if next[keyThumbprint(r.Key)] {
+			// Key is back.
+			changed = true
+			continue
+		}
+		retired = append(retired, r)
+	}
+	if h.overlap > 0 {
+		for _, key := range h.Current {
+			if next[keyThumbprint(key)] {
+				continue
+			}
+			logger.WithFields(logrus.Fields{
+				"kid":   key.KeyID,
+				"until": now.Add(h.overlap),
+			}).Warnln("key was removed from JWKS, still accepted until overlap window ends")
+			retired = append(retired, &retiredKey{
+				Key:       key,
+				RetiredAt: now,
+			})
+			changed = true
+		}
+	}
+	h.Current = jwks.Keys
+	h.Retired = retired
+
+	if h.prune(now, logger) {
+		changed = true
+	}
+	h.save(logger)
+
+	return changed
+}
+
+// prune removes all retired keys of the associated history where the overlap
+// window has ended at the provided time. Returns true if any key was removed.
+func (h *jwksHistory) prune(now time.Time, logger logrus.FieldLogger) bool {
+	retired := make([]*retiredKey, 0, len(h.Retired))
+	for _, r := range h.Retired {
+		if h.overlap > 0 && now.Before(r.RetiredAt.Add(h.overlap)) {
+			retired = append(retired, r)
+			continue
+		}
+		logger.WithField("kid", r.Key.KeyID).Infoln("retired key overlap window has ended, key removed")
+	}
+	if len(retired) == len(h.Retired) {
+		return false
+	}
+	h.Retired = retired
+	return true
+}
+
+// jwks returns the retired keys of the associated history as JWKS, or nil if
+// there are none.
+func (h *jwksHistory) jwks() *jose.JSONWebKeySet {
+	if len(h.Retired) == 0 {
+		return nil
+	}
+	jwks := &jose.JSONWebKeySet{
+		Keys: make([]jose.JSONWebKey, 0, len(h.Retired)),
+	}
+	for _, r := range h.Retired {
+		jwks.Keys = append(jwks.Keys, r.Key)
+	}
+	return jwks
+}
+
+// keyThumbprint returns an identifier for the provided key, which is its
+// thumbprint or its kid if the thumbprint cannot be computed.
+func keyThumbprint(key jose.JSONWebKey) string {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "kid:" + key.KeyID
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint)
+}
@@ -0,0 +1,189 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"stash.kopano.io/kgol/kustomer"
+	"stash.kopano.io/kgol/kustomer/license"
+)
+
+var licenseFileNameUnsafeRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// licenseKeySets bundles the key sets to validate licenses.
+type licenseKeySets struct {
+	jwks        *jose.JSONWebKeySet
+	retiredJWKS *jose.JSONWebKeySet
+	extraJWKS   *jose.JSONWebKeySet
+}
+
+// keySets returns the current key sets of the associated server. The caller
+// must hold the mutex.
+func (s *Server) keySets() licenseKeySets {
+	return licenseKeySets{
+		jwks:        s.jwks,
+		retiredJWKS: s.retiredJWKS,
+		extraJWKS:   s.extraJWKS,
+	}
+}
+
+// revocationList returns the current revocation list of the associated server,
+// merged from the fetched and the local revocation lists. The caller must hold
+// the mutex.
+func (s *Server) revocationList() *kustomer.RevocationList {
+	if s.revocations == nil && s.localRevocations == nil {
+		return nil
+	}
+	var remote *kustomer.RevocationList
+	if s.revocations != nil {
+		remote = &s.revocations.Revoked
+	}
+	return kustomer.MergeRevocationLists(remote, s.localRevocations)
+}
+
+// newLicensesLoader returns a licenses loader with the settings of the
+// associated server and the provided key sets and revocation list.
+func (s *Server) newLicensesLoader(keys licenseKeySets, revocations *kustomer.RevocationList, offline bool) *kustomer.LicensesLoader {
+	loader := &kustomer.LicensesLoader{
+		CertPool:         s.certPool,
+		ExtraCertPool:    s.config.ExtraCertPool,
+		CertPoolTrusted:  s.config.CertPoolTrusted,
+		Intermediates:    s.config.LicensesIntermediates,
+		CertExtKeyUsages: s.config.LicensesCertExtKeyUsages,
+		CertPolicies:     s.config.LicensesCertPolicies,
+		CRLs:             s.config.LicensesCRLs,
+
+		Include:   s.config.LicensesInclude,
+		Exclude:   s.config.LicensesExclude,
+		Recursive: s.config.LicensesRecursive,
+		Symlinks:  s.config.LicensesSymlinks,
+
+		Issuer:    s.config.LicensesIssuer,
+		Audiences: s.config.LicensesAudiences,
+
+		Host: s.host,
+
+		GracePeriod: s.config.LicensesGracePeriod,
+
+		JWKS:        keys.jwks,
+		RetiredJWKS: keys.retiredJWKS,
+		ExtraJWKS:   keys.extraJWKS,
+		JWKSTrusted: s.config.JWKSTrusted,
+		Offline:     offline,
+
+		Algorithms:    s.config.LicensesAlgorithms,
+		MinRSAKeySize: s.config.LicensesMinRSAKeySize,
+
+		DecryptionKey: s.config.HostKey,
+
+		Revocations: revocations,
+
+		Logger: s.logger,
+	}
+	if s.strictSub {
+		loader.Subject = s.sub
+	}
+	return loader
+}
+
+// fetchLicenses fetches the current licenses of the active sub with the
+// provided fetcher and stores all valid licenses which are not known yet in
+// the licenses fetch path. Returns true if any license was stored.
+func (s *Server) fetchLicenses(ctx context.Context, fetcher *kustomer.LicensesFetcher) (bool, error) {
+	s.mutex.RLock()
+	sub := s.sub
+	if sub == "" && len(s.claims) > 0 {
+		sub = s.claims[0].Claims.Subject
+	}
+	keys := s.keySets()
+	revocations := s.revocationList()
+	offline := !s.connectivity.online()
+	s.mutex.RUnlock()
+
+	logger := s.logger.WithField("uri", fetcher.URI.String())
+	if sub == "" {
+		logger.Debugln("no sub, skipping license fetch")
+		return false, nil
+	}
+
+	data, err := fetcher.Fetch(ctx, sub)
+	if err != nil {
+		return false, err
+	}
+	if data == nil {
+		logger.Debugln("fetched licenses not modified")
+		return false, nil
+	}
+
+	loader := s.newLicensesLoader(keys, revocations, offline)
+	claims := loader.Load(fetcher.URI.String(), data, jwt.Expected{
+		Time: time.Now(),
+	})
+	logger.WithFields(logrus.Fields{
+		"sub":   sub,
+		"count": len(claims),
+	}).Debugln("fetched licenses")
+
+	var stored bool
+	for _, c := range claims {
+		fn, storeErr := s.storeLicense(c)
+		if storeErr != nil {
+			// Make sure the next fetch does not get a not modified answer so
+			// storing is retried.
+			fetcher.Reset()
+			return stored, storeErr
+		}
+		if fn != "" {
+			logger.WithFields(logrus.Fields{
+				"name": fn,
+				"jti":  c.Claims.ID,
+			}).Infoln("fetched license stored")
+			stored = true
+		}
+	}
+
+	return stored, nil
+}
+
+// storeLicense writes the raw license of the provided claims into the licenses
+// fetch path, unless a file with the same license exists already. Returns the
+// name of the written file or empty string if nothing was written.
+func (s *Server) storeLicense(c *license.Claims) (string, error) {
+	id := c.Claims.ID
+	if id == "" {
+		id = c.LicenseFileID
+	}
+	if id == "" {
+		h := sha256.Sum256(c.Raw)
+		id = hex.EncodeToString(h[:])
+	}
+	fn := filepath.Join(s.licensesFetchPath, licenseFileNameUnsafeRegexp.ReplaceAllString(id, "_")+".license")
+
+	if existing, readErr := ioutil.ReadFile(fn); readErr == nil {
+		if bytes.Equal(bytes.TrimSpace(existing), c.Raw) {
+			return "", nil
+		}
+	}
+
+	//nolint:gosec // Licenses are not secret.
+	if err := writeFileAtomic(fn, append(c.Raw, '\n'), 0644); err != nil {
+		return "", err
+	}
+
+	return fn, nil
+}
@@ -0,0 +1,222 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"stash.kopano.io/kgol/kustomer"
+)
+
+func newTestLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+func newTestFetchServer(t *testing.T, dir string) (*Server, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		config: &Config{},
+		logger: newTestLogger(),
+		sub:    "test-customer",
+
+		connectivity: newConnectivity(offlineThreshold, time.Now()),
+
+		jwks: &jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{
+				Key:       publicKey,
+				KeyID:     "test-key",
+				Algorithm: string(jose.EdDSA),
+				Use:       "sig",
+			}},
+		},
+
+		licensesFetchPath: dir,
+	}, privateKey
+}
+
+func signTestFetchLicense(t *testing.T, privateKey ed25519.PrivateKey, id string, sub string, expiry time.Time) []byte {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.EdDSA,
+		Key:       privateKey,
+	}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(&jwt.Claims{
+		ID:        id,
+		Issuer:    "kopano",
+		Audience:  jwt.Audience{"kopano"},
+		Subject:   sub,
+		IssuedAt:  jwt.NewNumericDate(expiry.Add(-24 * time.Hour)),
+		NotBefore: jwt.NewNumericDate(expiry.Add(-24 * time.Hour)),
+		Expiry:    jwt.NewNumericDate(expiry),
+	}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(raw)
+}
+
+func TestFetchLicenses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kustomer-fetch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, privateKey := newTestFetchServer(t, dir)
+	now := time.Now()
+	valid := signTestFetchLicense(t, privateKey, "license/1", "test-customer", now.Add(time.Hour))
+	expired := signTestFetchLicense(t, privateKey, "expired", "test-customer", now.Add(-7*24*time.Hour))
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		if sub := req.URL.Query().Get("sub"); sub != "test-customer" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Write(bytes.Join([][]byte{valid, expired}, []byte("\n")))
+	}))
+	defer srv.Close()
+	uri, _ := url.Parse(srv.URL)
+	fetcher := &kustomer.LicensesFetcher{
+		URI:    uri,
+		Client: srv.Client(),
+	}
+
+	for _, step := range []struct {
+		name   string
+		before func()
+		stored bool
+	}{
+		{"new", func() {}, true},
+		{"not modified", func() {}, false},
+		{"unchanged", fetcher.Reset, false},
+		{"removed locally", func() {
+			fetcher.Reset()
+			os.Remove(filepath.Join(dir, "license_1.license"))
+		}, true},
+	} {
+		step.before()
+		stored, fetchErr := s.fetchLicenses(context.Background(), fetcher)
+		if fetchErr != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, fetchErr)
+		}
+		if stored != step.stored {
+			t.Errorf("%s: expected stored %v, got %v", step.name, step.stored, stored)
+		}
+
+		matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+		if len(matches) != 1 || filepath.Base(matches[0]) != "license_1.license" {
+			t.Fatalf("%s: expected only the valid license to be stored, got %v", step.name, matches)
+		}
+		data, readErr := ioutil.ReadFile(matches[0])
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if !bytes.Equal(data, append(valid, '\n')) {
+			t.Errorf("%s: stored license does not match fetched license", step.name)
+		}
+	}
+	if requests != 4 {
+		t.Errorf("expected 4 requests, got %d", requests)
+	}
+
+	// Without sub there is nothing to fetch.
+	s.sub = ""
+	if stored, fetchErr := s.fetchLicenses(context.Background(), fetcher); stored || fetchErr != nil {
+		t.Errorf("expected no fetch without sub, got %v %v", stored, fetchErr)
+	}
+	if requests != 4 {
+		t.Errorf("expected no request without sub, got %d", requests)
+	}
+
+	// Failing to store resets the fetcher, to retry with the next fetch.
+	s.sub = "test-customer"
+	s.licensesFetchPath = filepath.Join(dir, "missing")
+	fetcher.Reset()
+	if _, fetchErr := s.fetchLicenses(context.Background(), fetcher); fetchErr == nil {
+		t.Errorf("expected error when license cannot be stored")
+	}
+	if etag := fetcher.ETag(); etag != "" {
+		t.Errorf("expected fetcher to be reset after store error, got etag %s", etag)
+	}
+}
+
+func TestFetchLicensesRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kustomer-fetch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, privateKey := newTestFetchServer(t, dir)
+	s.strictSub = true
+	s.revocations = &kustomer.RevocationClaims{
+		Claims: &jwt.Claims{},
+		Revoked: kustomer.RevocationList{
+			IDs: []string{"revoked"},
+		},
+	}
+	s.localRevocations = &kustomer.RevocationList{
+		IDs: []string{"revoked-local"},
+	}
+	expiry := time.Now().Add(time.Hour)
+	data := bytes.Join([][]byte{
+		signTestFetchLicense(t, privateKey, "valid", "test-customer", expiry),
+		signTestFetchLicense(t, privateKey, "revoked", "test-customer", expiry),
+		signTestFetchLicense(t, privateKey, "revoked-local", "test-customer", expiry),
+		signTestFetchLicense(t, privateKey, "other-sub", "other-customer", expiry),
+	}, []byte("\n"))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(data)
+	}))
+	defer srv.Close()
+	uri, _ := url.Parse(srv.URL)
+	fetcher := &kustomer.LicensesFetcher{
+		URI:    uri,
+		Client: srv.Client(),
+	}
+
+	stored, err := s.fetchLicenses(context.Background(), fetcher)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !stored {
+		t.Errorf("expected valid license to be stored")
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(matches) != 1 || filepath.Base(matches[0]) != "valid.license" {
+		t.Errorf("expected only the valid license to be stored, got %v", matches)
+	}
+}
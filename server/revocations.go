@@ -0,0 +1,158 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"stash.kopano.io/kgol/kustomer"
+)
+
+const revocationsCacheFileName = "revocations.jwt"
+
+// loadCachedRevocations loads the revocation list from the cache file of the
+// associated server, if there is any.
+func (s *Server) loadCachedRevocations() {
+	if s.revocationsCacheFile == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(s.revocationsCacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.WithError(err).Warnln("failed to read cached revocation list")
+		}
+		return
+	}
+	token, err := jwt.ParseSigned(string(data))
+	if err == nil {
+		// NOTE(longsleep): The cache file was validated before it was written.
+		// Validating again is not possible when starting offline and does not
+		// add any protection, since removing the file has the same effect as
+		// replacing it with a list having less entries.
+		claims := &kustomer.RevocationClaims{}
+		err = token.UnsafeClaimsWithoutVerification(claims)
+		if err == nil {
+			s.mutex.Lock()
+			s.revocations = claims
+			s.mutex.Unlock()
+			s.logger.WithField("count", claims.Revoked.Len()).Debugln("cached revocation list loaded")
+		}
+	}
+	if err != nil {
+		s.logger.WithError(err).Warnln("failed to parse cached revocation list")
+	}
+}
+
+// updateRevocations fetches the revocation list with the provided fetcher,
+// validates it and replaces the current revocation list of the associated
+// server with it if it is not older. Returns true if the list was replaced.
+func (s *Server) updateRevocations(ctx context.Context, fetcher *kustomer.RevocationListFetcher) (bool, error) {
+	data, err := fetcher.Update(ctx)
+	if err != nil {
+		return false, err
+	}
+	if data == nil {
+		// Not modified.
+		return false, nil
+	}
+
+	var claims *kustomer.RevocationClaims
+	if len(data) > 0 {
+		s.mutex.RLock()
+		// Only the JWKS, the revocation list is fetched next to it.
+		loader := s.newLicensesLoader(licenseKeySets{
+			jwks:        s.jwks,
+			retiredJWKS: s.retiredJWKS,
+		}, nil, false)
+		s.mutex.RUnlock()
+		claims, err = loader.LoadRevocationList("remote", data)
+		if err != nil {
+			fetcher.Reset()
+			return false, err
+		}
+	} else {
+		claims = &kustomer.RevocationClaims{
+			Claims: &jwt.Claims{},
+		}
+	}
+
+	s.mutex.Lock()
+	current := s.revocations
+	if current != nil && current.Claims != nil && current.Claims.IssuedAt != nil {
+		if claims.Claims.IssuedAt == nil || claims.Claims.IssuedAt.Time().Before(current.Claims.IssuedAt.Time()) {
+			s.mutex.Unlock()
+			if claims.Claims.IssuedAt != nil {
+				s.logger.Warnln("fetched revocation list is older than the current one, ignored")
+			}
+			return false, nil
+		}
+	}
+	s.revocations = claims
+	s.mutex.Unlock()
+
+	s.logger.WithField("count", claims.Revoked.Len()).Debugln("revocation list updated")
+
+	if s.revocationsCacheFile != "" && len(data) > 0 {
+		if writeErr := writeFileAtomic(s.revocationsCacheFile, data, 0600); writeErr != nil {
+			s.logger.WithError(writeErr).Warnln("failed to write revocation list cache")
+		}
+	}
+
+	return true, nil
+}
+
+// A revocationsFile tracks a local revocation list file.
+type revocationsFile struct {
+	path string
+
+	modTime time.Time
+	list    *kustomer.RevocationList
+}
+
+// update loads the revocation list of the associated file, if the file was
+// modified or if force is true. Returns true if the list has changed.
+func (rf *revocationsFile) update(loader *kustomer.LicensesLoader, logger logrus.FieldLogger, force bool) bool {
+	info, err := os.Stat(rf.path)
+	if err != nil {
+		if !rf.modTime.IsZero() {
+			logger.WithError(err).WithField("name", rf.path).Warnln("revocations file is gone")
+			rf.modTime = time.Time{}
+			rf.list = nil
+			return true
+		}
+		return false
+	}
+	if !force && info.ModTime().Equal(rf.modTime) {
+		return false
+	}
+	rf.modTime = info.ModTime()
+	rf.list = nil
+
+	data, err := ioutil.ReadFile(rf.path)
+	if err == nil {
+		var claims *kustomer.RevocationClaims
+		claims, err = loader.LoadRevocationList(rf.path, data)
+		if err == nil {
+			rf.list = &claims.Revoked
+			logger.WithFields(logrus.Fields{
+				"name":  rf.path,
+				"count": rf.list.Len(),
+			}).Infoln("revocations file loaded")
+		}
+	}
+	if err != nil {
+		logger.WithError(err).WithField("name", rf.path).Errorln("failed to load revocations file")
+	}
+
+	return true
+}
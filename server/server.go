@@ -16,6 +16,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -31,6 +32,7 @@ import (
 
 	"stash.kopano.io/kgol/kustomer"
 	"stash.kopano.io/kgol/kustomer/license"
+	api "stash.kopano.io/kgol/kustomer/server/api-v1"
 	"stash.kopano.io/kgol/kustomer/version"
 )
 
@@ -42,6 +44,13 @@ const (
 	defaultHTTPTLSHandshakeTimeout   = 10 * time.Second
 	defaultHTTPExpectContinueTimeout = 1 * time.Second
 
+	defaultLicensesFetchInterval = 6 * time.Hour
+
+	licensesGraceWarningInterval = 1 * time.Hour
+
+	licensesScanInterval   = 60 * time.Second
+	healthHeartbeatTimeout = 5 * licensesScanInterval
+
 	offlineThreshold uint = 3
 )
 
@@ -53,20 +62,38 @@ type Server struct {
 
 	config *Config
 
-	logger      logrus.FieldLogger
-	licensePath string
-	listenPath  string
-	sub         string
+	logger         logrus.FieldLogger
+	licenseSources []*kustomer.LicenseSource
+	listenPath     string
+	sub            string
+	strictSub      bool
+	host           *kustomer.HostIdentity
+
+	licensesFetchURI      *url.URL
+	licensesFetchPath     string
+	licensesFetchInterval time.Duration
 
 	insecure bool
 	trusted  bool
 
-	offline          uint
-	offlineThreshold uint
+	connectivity *connectivity
+
+	jwksURIs    []*url.URL
+	jwks        *jose.JSONWebKeySet
+	retiredJWKS *jose.JSONWebKeySet
+	certPool    *x509.CertPool
+	jwksHistory *jwksHistory
+
+	extraJWKSURIs []*url.URL
+	extraJWKS     *jose.JSONWebKeySet
+
+	revocations          *kustomer.RevocationClaims
+	revocationsCacheFile string
+	revocationsFile      string
+	localRevocations     *kustomer.RevocationList
 
-	jwksURIs []*url.URL
-	jwks     *jose.JSONWebKeySet
-	certPool *x509.CertPool
+	audit   *auditLog
+	history *historyStore
 
 	httpClient *http.Client
 
@@ -75,6 +102,11 @@ type Server struct {
 	updateCh chan struct{}
 	closeCh  chan struct{}
 	claims   []*license.Claims
+	watchers map[chan *event]struct{}
+
+	heartbeat  time.Time
+	lastScan   time.Time
+	lastStatus string
 }
 
 // NewServer constructs a server from the provided parameters.
@@ -86,33 +118,108 @@ func NewServer(c *Config) (*Server, error) {
 		insecure: c.Insecure,
 		trusted:  c.Trusted,
 
-		offline:          offlineThreshold,
-		offlineThreshold: offlineThreshold,
+		connectivity: newConnectivity(offlineThreshold, time.Now()),
 
 		jwksURIs: c.JWKSURIs,
 		certPool: c.CertPool,
+		jwksHistory: &jwksHistory{
+			overlap: c.LicensesKeyOverlap,
+		},
+		history: &historyStore{
+			retention: c.HistoryRetention,
+		},
+
+		extraJWKSURIs: c.ExtraJWKSURIs,
 
 		readyCh:  make(chan struct{}),
 		reloadCh: make(chan chan struct{}),
 		updateCh: make(chan struct{}),
 		closeCh:  make(chan struct{}),
+		watchers: make(map[chan *event]struct{}),
 	}
 
 	if c.Sub != "" {
 		// Check if provided sub is email.
-		s.sub = strings.TrimSpace(c.Sub)
-		if isValidEmail(s.sub) {
-			s.sub = hashSub(s.sub)
+		s.sub = normalizeSub(c.Sub)
+	}
+	host, err := kustomer.NewHostIdentity(c.ClusterID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host identity: %w", err)
+	}
+	s.host = host
+	s.logger.WithFields(logrus.Fields{
+		"mid":  host.MachineID,
+		"host": host.Hostname,
+		"cid":  host.ClusterID,
+	}).Infoln("host identity for license binding")
+
+	if c.StrictSub {
+		if s.sub == "" {
+			return nil, fmt.Errorf("strict sub requires a sub")
 		}
+		s.strictSub = true
 	}
 
-	if c.LicensesPath != "" {
-		// Validate license path
-		licensePath, absErr := filepath.Abs(c.LicensesPath)
+	for _, src := range c.LicenseSources {
+		if src.Type == kustomer.LicenseSourceTypeFolder {
+			// Validate license path
+			licensePath, absErr := filepath.Abs(src.Path)
+			if absErr != nil {
+				return nil, fmt.Errorf("invalid license path: %w", absErr)
+			}
+			folder := *src
+			folder.Path = licensePath
+			src = &folder
+		}
+		s.licenseSources = append(s.licenseSources, src)
+	}
+	if c.LicensesFetchURI != nil {
+		s.licensesFetchURI = c.LicensesFetchURI
+		s.licensesFetchPath = c.LicensesFetchPath
+		if s.licensesFetchPath == "" {
+			// Default to the first licenses folder.
+			for _, src := range s.licenseSources {
+				if src.Type == kustomer.LicenseSourceTypeFolder {
+					s.licensesFetchPath = src.Path
+					break
+				}
+			}
+		}
+		if s.licensesFetchPath == "" {
+			return nil, fmt.Errorf("licenses fetch path is required for license fetching")
+		}
+		licensesFetchPath, absErr := filepath.Abs(s.licensesFetchPath)
+		if absErr != nil {
+			return nil, fmt.Errorf("invalid licenses fetch path: %w", absErr)
+		}
+		s.licensesFetchPath = licensesFetchPath
+		s.licensesFetchInterval = c.LicensesFetchInterval
+		if s.licensesFetchInterval <= 0 {
+			s.licensesFetchInterval = defaultLicensesFetchInterval
+		}
+	}
+	if c.StatePath != "" {
+		statePath, absErr := filepath.Abs(c.StatePath)
 		if absErr != nil {
-			return nil, fmt.Errorf("invalid license path: %w", absErr)
+			return nil, fmt.Errorf("invalid state path: %w", absErr)
 		}
-		s.licensePath = licensePath
+		s.revocationsCacheFile = filepath.Join(statePath, revocationsCacheFileName)
+		s.jwksHistory.path = filepath.Join(statePath, jwksHistoryFileName)
+		s.history.path = filepath.Join(statePath, historyFileName)
+	}
+	if c.RevocationsFile != "" {
+		revocationsFile, absErr := filepath.Abs(c.RevocationsFile)
+		if absErr != nil {
+			return nil, fmt.Errorf("invalid revocations file: %w", absErr)
+		}
+		s.revocationsFile = revocationsFile
+	}
+	if c.AuditLogPath != "" {
+		audit, auditErr := newAuditLog(c.AuditLogPath, c.AuditLogMaxSize, c.AuditLogRetention, s.logger)
+		if auditErr != nil {
+			return nil, auditErr
+		}
+		s.audit = audit
 	}
 	if c.ListenPath != "" {
 		// Validate listen path
@@ -162,31 +269,84 @@ func NewServer(c *Config) (*Server, error) {
 func (s *Server) AddRoutes(ctx context.Context, router *mux.Router) {
 	// TODO(longsleep): Add subpath support to all handlers and paths.
 	router.HandleFunc("/health-check", s.HealthCheckHandler)
+	router.HandleFunc("/health/live", s.HealthLiveHandler)
+	router.HandleFunc("/health/ready", s.HealthReadyHandler)
 	router.HandleFunc("/reload", s.ReloadHandler)
 	router.HandleFunc("/api/v1/claims-gen", s.ClaimsGenHandler)
 	router.HandleFunc("/api/v1/claims", s.ClaimsHandler)
 	router.HandleFunc("/api/v1/claims/kopano/products", s.ClaimsKopanoProductsHandler)
 	router.HandleFunc("/api/v1/claims/watch", s.MakeClaimsWatchHandler())
+	router.HandleFunc("/api/v1/history", s.HistoryHandler)
 }
 
-// Serve starts all the accociated servers resources and listeners and blocks
-// forever until signals or error occurs.
-func (s *Server) Serve(ctx context.Context) error {
-	var err error
+// reload triggers a license scan and waits until it is complete, calling the
+// OnReload hook before and after.
+func (s *Server) reload(ctx context.Context) {
+	s.audit.record(&auditRecord{
+		Event:   auditEventReload,
+		Trigger: "signal",
+	})
+	if s.config.OnReload != nil {
+		s.config.OnReload(s, false)
+	}
+	cbCh := make(chan struct{})
+	select {
+	case s.reloadCh <- cbCh:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-cbCh:
+	case <-ctx.Done():
+		return
+	}
+	if s.config.OnReload != nil {
+		s.config.OnReload(s, true)
+	}
+}
 
-	serveCtx, serveCtxCancel := context.WithCancel(ctx)
-	defer serveCtxCancel()
+// Status returns a short status summary of the associated server with its
+// online state and the active products.
+func (s *Server) Status() string {
+	s.mutex.RLock()
+	state := s.connectivity.state
+	products := []string{}
+	for _, c := range s.claims {
+		for name := range c.Kopano.Products {
+			products = appendIfMissingS(products, name)
+		}
+	}
+	s.mutex.RUnlock()
 
-	logger := s.logger
+	if len(products) == 0 {
+		return fmt.Sprintf("%s, no licensed products active", state)
+	}
+	sort.Strings(products)
+	return fmt.Sprintf("%s, %d licensed products active: %s", state, len(products), strings.Join(products, ", "))
+}
 
-	errCh := make(chan error, 2)
-	exitCh := make(chan struct{}, 1)
-	signalCh := make(chan os.Signal, 1)
-	readyCh := make(chan struct{}, 1)
-	triggerCh := make(chan bool, 1)
+// reportStatus calls the OnStatus hook if the status has changed.
+func (s *Server) reportStatus() {
+	if s.config.OnStatus == nil {
+		return
+	}
+	status := s.Status()
+	s.mutex.Lock()
+	changed := status != s.lastStatus
+	s.lastStatus = status
+	s.mutex.Unlock()
+	if changed {
+		s.config.OnStatus(s, status)
+	}
+}
+
+// listen creates the unix socket listener at the listen path of the associated
+// server, cleaning up unused existing sockets.
+func (s *Server) listen() (net.Listener, error) {
+	logger := s.logger
 
 	// Check if listen socket can be created.
-	err = func() error {
+	err := func() error {
 		_, statErr := os.Stat(s.listenPath)
 		switch {
 		case statErr == nil:
@@ -224,7 +384,7 @@ func (s *Server) Serve(ctx context.Context) error {
 		return nil
 	}()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	logger.WithField("socket", s.listenPath).Infoln("starting http listener")
 	// NOTE(longsleep): On Linux, connecting to a stream socket object requires
@@ -234,7 +394,36 @@ func (s *Server) Serve(ctx context.Context) error {
 	listener, err := net.Listen("unix", s.listenPath)
 	unix.Umask(umask) // Restore previous umask.
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// Serve starts all the accociated servers resources and listeners and blocks
+// forever until signals or error occurs.
+func (s *Server) Serve(ctx context.Context) error {
+	var err error
+
+	serveCtx, serveCtxCancel := context.WithCancel(ctx)
+	defer serveCtxCancel()
+
+	logger := s.logger
+
+	errCh := make(chan error, 2)
+	exitCh := make(chan struct{}, 1)
+	signalCh := make(chan os.Signal, 1)
+	readyCh := make(chan struct{}, 1)
+	triggerCh := make(chan string, 1)
+
+	listener := s.config.Listener
+	if listener != nil {
+		logger.WithField("socket", listener.Addr().String()).Infoln("starting http listener with provided listener")
+	} else {
+		listener, err = s.listen()
+		if err != nil {
+			return err
+		}
 	}
 
 	router := mux.NewRouter()
@@ -249,17 +438,25 @@ func (s *Server) Serve(ctx context.Context) error {
 	}
 	srv.SetKeepAlivesEnabled(false)
 
-	// Load JWKS if we have one.
-	go func() {
-		if len(s.jwksURIs) == 0 {
-			logger.Warnln("no JWKS URIs are set, running in offline mode")
-			close(readyCh)
-			return
-		}
+	// Load cached revocation list, so it is available before going online.
+	s.loadCachedRevocations()
 
-		var started bool
-		var offline uint
-		fetcher := kustomer.JWKSFetcher{
+	// Load JWKS history, so retired keys are available before going online.
+	s.jwksHistory.load(logger)
+	s.history.load(time.Now(), logger)
+	if s.jwksHistory.prune(time.Now(), logger) {
+		s.jwksHistory.save(logger)
+	}
+	s.mutex.Lock()
+	s.retiredJWKS = s.jwksHistory.jwks()
+	s.mutex.Unlock()
+
+	// Load JWKS if we have one.
+	if len(s.jwksURIs) == 0 {
+		logger.Warnln("no JWKS URIs are set, running in offline mode")
+		close(readyCh)
+	} else {
+		fetcher := &kustomer.JWKSFetcher{
 			URIs:      s.jwksURIs,
 			UserAgent: DefaultHTTPUserAgent,
 
@@ -267,58 +464,181 @@ func (s *Server) Serve(ctx context.Context) error {
 			Logger: logger,
 
 			MaxRetries: 3,
+			HedgeDelay: s.config.JWKSHedgeDelay,
+			Interval:   60 * time.Minute,
 		}
-		for {
-			jwks, requestErr := fetcher.Update(serveCtx)
-			s.mutex.Lock()
-			if requestErr != nil {
-				logger.WithError(requestErr).Warnln("unable to fetch JWKS")
-			} else if jwks != nil {
-				logger.WithField("keys", len(jwks.Keys)).Debugln("JWKS loaded successfully")
-				s.jwks = jwks
-				if started {
-					triggerCh <- true
-				}
+		if s.config.JWKSSigned {
+			// Only accept JWKS signed with a key chaining to the root
+			// certificates, so mirrors cannot inject keys.
+			loader := s.newLicensesLoader(licenseKeySets{}, nil, true)
+			fetcher.Decode = func(data []byte) (*jose.JSONWebKeySet, error) {
+				return loader.LoadSignedJWKS(data, time.Now())
 			}
-			offline = s.offline
-			if o := fetcher.Offline(); o {
-				offline++
-				if offline > s.offlineThreshold {
-					offline = s.offlineThreshold
-				}
-			} else {
-				offline = 0
+		}
+		revocationsFetcher := &kustomer.RevocationListFetcher{
+			URIs:      make([]*url.URL, 0, len(s.jwksURIs)),
+			UserAgent: DefaultHTTPUserAgent,
+
+			Client: s.httpClient,
+			Logger: logger,
+		}
+		for _, uri := range s.jwksURIs {
+			if uri.Scheme != "https" && uri.Scheme != "http" {
+				continue
 			}
-			if s.offline != offline {
-				s.offline = offline
-				if started {
-					if offline > 0 {
-						if offline > s.offlineThreshold {
-							logger.Warnln("now offline")
-						} else {
-							logger.Debugln("now offline (threshold not reached yet)")
+			// Revocation list is next to the JWKS.
+			revocationsFetcher.URIs = append(revocationsFetcher.URIs, uri.ResolveReference(&url.URL{
+				Path: kustomer.DefaultRevocationListName,
+			}))
+		}
+
+		updates := fetcher.Subscribe()
+		fetcher.Start(serveCtx)
+		go func() {
+			defer fetcher.Unsubscribe(updates)
+
+			var started bool
+			for {
+				var update *kustomer.JWKSUpdate
+				select {
+				case <-serveCtx.Done():
+					return
+				case update = <-updates:
+				}
+				for _, stats := range fetcher.Stats() {
+					logger.WithFields(logrus.Fields{
+						"uri":          stats.URI,
+						"requests":     stats.Requests,
+						"successes":    stats.Successes,
+						"failures":     stats.Failures,
+						"cancelled":    stats.Cancelled,
+						"last_latency": stats.LastLatency,
+						"last_error":   stats.LastError,
+					}).Debugln("JWKS mirror statistics")
+				}
+				var keysChanged bool
+				s.mutex.Lock()
+				if update.Err != nil {
+					logger.WithError(update.Err).Warnln("unable to fetch JWKS")
+				} else if jwks := fetcher.JWKS(); update.Changed && jwks != nil {
+					logger.WithField("keys", len(jwks.Keys)).Debugln("JWKS loaded successfully")
+					s.jwks = jwks
+					if s.jwksHistory.update(jwks, time.Now(), logger) {
+						s.retiredJWKS = s.jwksHistory.jwks()
+					}
+					keysChanged = true
+				} else if s.jwksHistory.prune(time.Now(), logger) {
+					s.jwksHistory.save(logger)
+					s.retiredJWKS = s.jwksHistory.jwks()
+					keysChanged = true
+				}
+				var transition *api.ConnectivityResponse
+				if previous := s.connectivity.record(!update.Offline, time.Now()); previous != "" {
+					transition = s.connectivity.response()
+					fields := logrus.Fields{
+						"state":    transition.State,
+						"previous": previous,
+						"failures": transition.Failures,
+					}
+					switch transition.State {
+					case onlineStateOnline:
+						logger.WithFields(fields).Infoln("now online")
+					case onlineStateDegraded:
+						logger.WithFields(fields).Debugln("now degraded (offline threshold not reached yet)")
+					case onlineStateOffline:
+						logger.WithFields(fields).Warnln("now offline")
+					}
+				}
+				offline := !s.connectivity.online()
+				s.mutex.Unlock()
+				if keysChanged && started {
+					// Never block while holding the lock, a pending trigger
+					// scans with the new keys as well.
+					select {
+					case triggerCh <- scanTriggerKeys:
+					default:
+					}
+				}
+				if transition != nil {
+					s.notify("online-state", transition)
+					s.reportStatus()
+					if started {
+						// Offline validation depends on the state.
+						select {
+						case triggerCh <- scanTriggerConnectivity:
+						default:
 						}
-					} else {
-						logger.Warnln("no longer offline")
 					}
 				}
-			}
-			s.mutex.Unlock()
-			if !started {
-				close(readyCh)
-				started = true
-				if offline > 0 {
-					logger.Warnln("started in offline mode, no JWKS is loaded")
+				if update.Err == nil {
+					if updated, updateErr := s.updateRevocations(serveCtx, revocationsFetcher); updateErr != nil {
+						logger.WithError(updateErr).Warnln("unable to update revocation list")
+					} else if updated && started {
+						select {
+						case triggerCh <- scanTriggerRevocations:
+						default:
+						}
+					}
+				}
+				if !started {
+					close(readyCh)
+					started = true
+					if offline {
+						logger.Warnln("started in offline mode, no JWKS is loaded")
+					}
 				}
 			}
-			select {
-			case <-serveCtx.Done():
-				return
-			case <-time.After(60 * time.Minute):
-				// Refresh.
-			}
+		}()
+	}
+
+	// Load additional JWKS if we have any.
+	if len(s.extraJWKSURIs) > 0 {
+		fetchers := make([]*kustomer.JWKSFetcher, 0, len(s.extraJWKSURIs))
+		for _, uri := range s.extraJWKSURIs {
+			fetchers = append(fetchers, &kustomer.JWKSFetcher{
+				URIs:      []*url.URL{uri},
+				UserAgent: DefaultHTTPUserAgent,
+
+				Client: s.httpClient,
+				Logger: logger.WithField("uri", uri.String()),
+
+				MaxRetries: 1,
+				Interval:   5 * time.Minute,
+			})
 		}
-	}()
+		for _, fetcher := range fetchers {
+			updates := fetcher.Subscribe()
+			fetcher.Start(serveCtx)
+			go func(fetcher *kustomer.JWKSFetcher) {
+				defer fetcher.Unsubscribe(updates)
+				for {
+					select {
+					case <-serveCtx.Done():
+						return
+					case update := <-updates:
+						if !update.Changed {
+							continue
+						}
+					}
+					// Merge all keys into one set.
+					extraJWKS := &jose.JSONWebKeySet{}
+					s.mutex.Lock()
+					for _, f := range fetchers {
+						if jwks := f.JWKS(); jwks != nil {
+							extraJWKS.Keys = append(extraJWKS.Keys, jwks.Keys...)
+						}
+					}
+					s.extraJWKS = extraJWKS
+					s.mutex.Unlock()
+					logger.WithField("keys", len(extraJWKS.Keys)).Debugln("additional JWKS loaded successfully")
+					select {
+					case triggerCh <- scanTriggerKeys:
+					default:
+					}
+				}
+			}(fetcher)
+		}
+	}
 
 	// HTTP listener.
 	go func() {
@@ -373,66 +693,161 @@ func (s *Server) Serve(ctx context.Context) error {
 		}
 	}()
 
+	// Remote license fetching.
+	if s.licensesFetchURI != nil {
+		go func() {
+			fetcher := &kustomer.LicensesFetcher{
+				URI:       s.licensesFetchURI,
+				UserAgent: DefaultHTTPUserAgent,
+
+				Client: s.httpClient,
+				Logger: logger,
+			}
+			select {
+			case <-serveCtx.Done():
+				return
+			case <-s.readyCh:
+			}
+			logger.WithFields(logrus.Fields{
+				"uri":  s.licensesFetchURI.String(),
+				"path": s.licensesFetchPath,
+			}).Infoln("license fetching enabled")
+			for {
+				stored, fetchErr := s.fetchLicenses(serveCtx, fetcher)
+				if fetchErr != nil {
+					logger.WithError(fetchErr).Warnln("failed to fetch licenses")
+				} else if stored {
+					select {
+					case triggerCh <- scanTriggerFetch:
+					default:
+					}
+				}
+				select {
+				case <-serveCtx.Done():
+					return
+				case <-time.After(s.licensesFetchInterval):
+					// Refresh.
+				}
+			}
+		}()
+	}
+
 	// License loading / watching.
 	go func() {
 		loadHistory := make(map[string]*license.Claims)
 		activateHistory := make(map[string]*license.Claims)
 		var lastSub string
 		var first bool = true
-		var jwks *jose.JSONWebKeySet
+		var keys licenseKeySets
+		var revocations *kustomer.RevocationClaims
 		var offline bool
-		f := func() {
+		var lastGraceWarning time.Time
+		localRevocations := &revocationsFile{
+			path: s.revocationsFile,
+		}
+		f := func(trigger string) {
+			var reset bool
 			s.mutex.RLock()
-			if jwks != s.jwks {
-				jwks = s.jwks
-				loadHistory = make(map[string]*license.Claims)
+			if current := s.keySets(); keys != current {
+				keys = current
+				reset = true
+			}
+			if revocations != s.revocations {
+				revocations = s.revocations
+				reset = true
 			}
-			offline = s.offline > 0
+			offline = !s.connectivity.online()
 			s.mutex.RUnlock()
 
+			if localRevocations.path != "" {
+				if localRevocations.update(s.newLicensesLoader(keys, nil, offline), logger, reset) {
+					s.mutex.Lock()
+					s.localRevocations = localRevocations.list
+					s.mutex.Unlock()
+					reset = true
+				}
+			}
+			if reset {
+				loadHistory = make(map[string]*license.Claims)
+			}
+
 			var sub string
 			var claims []*license.Claims
 			var changed bool
 			// Load and parse license files.
-			if s.licensePath != "" {
-				scanner := &kustomer.LicensesLoader{
-					CertPool: s.certPool,
-
-					JWKS:    jwks,
-					Offline: offline,
-
-					Logger: logger,
-
-					LoadHistory:     loadHistory,
-					ActivateHistory: activateHistory,
-
-					OnActivate: func(c *license.Claims) {
-						products := []string{}
-						for k := range c.Kopano.Products {
-							products = append(products, k)
-						}
-						logger.WithFields(logrus.Fields{
-							"name":     c.LicenseFileName,
-							"products": products,
-							"id":       c.Claims.ID,
-							"customer": c.Claims.Subject,
-						}).Infoln("licensed products activated")
-
-					},
-					OnRemove: func(c *license.Claims) {
-						logger.WithField("id", c.LicenseID).Debugln("removed, triggering")
-						changed = true
-					},
-					OnNew: func(c *license.Claims) {
-						logger.WithField("id", c.LicenseID).Debugln("new, triggering")
-						changed = true
-					},
-					OnSkip: func(c *license.Claims) {
-						logger.WithField("name", c.LicenseFileName).Infoln("skipped")
-					},
+			if len(s.licenseSources) > 0 {
+				s.mutex.RLock()
+				revocationList := s.revocationList()
+				s.mutex.RUnlock()
+				scanner := s.newLicensesLoader(keys, revocationList, offline)
+				scanner.LoadHistory = loadHistory
+				scanner.ActivateHistory = activateHistory
+				scanner.OnActivate = func(c *license.Claims) {
+					products := []string{}
+					for k := range c.Kopano.Products {
+						products = append(products, k)
+					}
+					logger.WithFields(logrus.Fields{
+						"name":     c.LicenseFileName,
+						"source":   c.LicenseSource,
+						"products": products,
+						"id":       c.LicenseID,
+						"jti":      c.Claims.ID,
+						"sub":      c.Claims.Subject,
+					}).Infoln("licensed products activated")
+					s.audit.record(&auditRecord{
+						Event:   auditEventLicenseActivated,
+						License: newAuditLicense(c),
+					})
+				}
+				scanner.OnRemove = func(c *license.Claims) {
+					logger.WithField("id", c.LicenseID).Debugln("removed, triggering")
+					changed = true
+					event := auditEventLicenseRemoved
+					if c.Claims.Expiry != nil && c.Claims.Expiry.Time().Before(time.Now()) {
+						event = auditEventLicenseExpired
+					}
+					s.audit.record(&auditRecord{
+						Event:   event,
+						License: newAuditLicense(c),
+					})
+				}
+				scanner.OnNew = func(c *license.Claims) {
+					logger.WithField("id", c.LicenseID).Debugln("new, triggering")
+					changed = true
+				}
+				scanner.OnSkip = func(c *license.Claims) {
+					logger.WithField("name", c.LicenseFileName).Infoln("skipped")
+					// Skipped licenses are replaced by a newer license with the
+					// same file ID.
+					s.audit.record(&auditRecord{
+						Event:   auditEventLicenseReplaced,
+						License: newAuditLicense(c),
+					})
+				}
+				scanner.OnGrace = func(c *license.Claims) {
+					logger.WithField("id", c.LicenseID).Debugln("grace, triggering")
+					changed = true
+					lastGraceWarning = time.Now()
+					s.notify("license-grace", map[string]interface{}{
+						"id":          c.LicenseID,
+						"name":        c.LicenseFileName,
+						"expiry":      c.Claims.Expiry,
+						"grace_until": c.GraceUntil.Unix(),
+					})
+				}
+				scanner.OnRevoke = func(c *license.Claims) {
+					s.notify("license-revoked", map[string]string{
+						"id":   c.LicenseID,
+						"name": c.LicenseFileName,
+					})
+					s.audit.record(&auditRecord{
+						Event:   auditEventLicenseRevoked,
+						License: newAuditLicense(c),
+					})
 				}
 				var scanErr error
-				claims, scanErr = scanner.ScanFolder(s.licensePath, jwt.Expected{
+				claims, scanErr = scanner.Scan(s.licenseSources, jwt.Expected{
 					Time: time.Now(),
 				})
 				if scanErr != nil {
@@ -440,6 +855,29 @@ func (s *Server) Serve(ctx context.Context) error {
 				}
 			}
 
+			if time.Since(lastGraceWarning) > licensesGraceWarningInterval {
+				for _, c := range claims {
+					if !c.GraceUntil.IsZero() {
+						logger.WithFields(logrus.Fields{
+							"name":        c.LicenseFileName,
+							"id":          c.LicenseID,
+							"grace_until": c.GraceUntil,
+						}).Warnln("license is expired and in its grace period - renew the license now")
+						lastGraceWarning = time.Now()
+					}
+				}
+			}
+
+			if changed {
+				subs := []string{}
+				for _, c := range claims {
+					subs = appendIfMissingS(subs, normalizeSub(c.Claims.Subject))
+				}
+				if len(subs) > 1 {
+					logger.WithField("subs", subs).Warnln("licenses of multiple customers are active")
+				}
+			}
+
 			// Add global configured sub to beginning.
 			if s.sub != "" {
 				if changed {
@@ -468,6 +906,12 @@ func (s *Server) Serve(ctx context.Context) error {
 			s.updateCh = make(chan struct{})
 			s.mutex.Unlock()
 
+			s.reportStatus()
+
+			if s.history.record(claims, s.kopanoProducts(claims, nil), trigger, time.Now(), logger) {
+				logger.WithField("trigger", trigger).Debugln("license history recorded")
+			}
+
 			if first {
 				close(s.readyCh)
 				first = false
@@ -477,6 +921,15 @@ func (s *Server) Serve(ctx context.Context) error {
 			}
 			close(updateCh)
 		}
+		scan := func(trigger string) {
+			s.mutex.Lock()
+			s.heartbeat = time.Now()
+			s.mutex.Unlock()
+			f(trigger)
+			s.mutex.Lock()
+			s.lastScan = time.Now()
+			s.mutex.Unlock()
+		}
 		select {
 		case <-serveCtx.Done():
 			return
@@ -485,7 +938,7 @@ func (s *Server) Serve(ctx context.Context) error {
 			case <-triggerCh:
 			default:
 			}
-			f()
+			scan(scanTriggerStartup)
 		}
 		for {
 			select {
@@ -497,16 +950,17 @@ func (s *Server) Serve(ctx context.Context) error {
 				default:
 				}
 				logger.Infoln("reload requested, scanning licenses")
-				f()
+				s.audit.reopen()
+				scan(scanTriggerReload)
 				close(cbCh)
-			case <-triggerCh:
-				f()
-			case <-time.After(60 * time.Second):
+			case trigger := <-triggerCh:
+				scan(trigger)
+			case <-time.After(licensesScanInterval):
 				select {
 				case <-triggerCh:
 				default:
 				}
-				f()
+				scan(scanTriggerInterval)
 			}
 		}
 	}()
@@ -518,12 +972,12 @@ func (s *Server) Serve(ctx context.Context) error {
 		case <-readyCh:
 		}
 		s.mutex.RLock()
-		offline := s.offline
+		state := s.connectivity.state
 		s.mutex.RUnlock()
 		logger.WithFields(logrus.Fields{
 			"insecure": s.insecure,
 			"trusted":  s.trusted,
-			"offline":  offline,
+			"state":    state,
 		}).Infoln("ready")
 	}()
 
@@ -537,10 +991,7 @@ func (s *Server) Serve(ctx context.Context) error {
 			case reason := <-signalCh:
 				if reason == syscall.SIGHUP {
 					logger.Infoln("reload signal received, scanning licenses")
-					select {
-					case triggerCh <- true:
-					default:
-					}
+					go s.reload(serveCtx)
 					continue
 				}
 				logger.WithField("signal", reason).Warnln("received signal")
@@ -578,6 +1029,7 @@ func (s *Server) Serve(ctx context.Context) error {
 		}
 	}()
 	shutDownCtxCancel() // prevent leak.
+	s.audit.close()
 
 	return err
 }
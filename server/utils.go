@@ -8,7 +8,11 @@ package server
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 var emailRegexp = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
@@ -22,6 +26,16 @@ func hashSub(sub string) string {
 	return hex.EncodeToString(h[:])
 }
 
+// normalizeSub returns the provided sub with whitespace trimmed and hashed if
+// it is an email address.
+func normalizeSub(sub string) string {
+	sub = strings.TrimSpace(sub)
+	if isValidEmail(sub) {
+		return hashSub(sub)
+	}
+	return sub
+}
+
 func appendIfMissingS(slice []string, s string) []string {
 	for _, v := range slice {
 		if v == s {
@@ -30,3 +44,40 @@ func appendIfMissingS(slice []string, s string) []string {
 	}
 	return append(slice, s)
 }
+
+// writeFileAtomic writes the provided data to a temporary file next to the
+// file with the provided name and then renames it.
+func writeFileAtomic(fn string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// appendFile appends the provided data to the file with the provided name,
+// creating it if it does not exist.
+func appendFile(fn string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
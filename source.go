@@ -0,0 +1,97 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// LicenseSourceOfflineOnly is the option to restrict a license source to
+// licenses which can be validated offline.
+const LicenseSourceOfflineOnly = "offline"
+
+// A LicenseSourceType defines where the licenses of a LicenseSource are loaded
+// from.
+type LicenseSourceType string
+
+// Supported license source types.
+const (
+	LicenseSourceTypeFolder LicenseSourceType = ""
+	LicenseSourceTypeEnv    LicenseSourceType = "env"
+	LicenseSourceTypeData   LicenseSourceType = "data"
+)
+
+// A LicenseSource defines a location where licenses are loaded from.
+type LicenseSource struct {
+	// Type is the type of the source. Defaults to a folder.
+	Type LicenseSourceType
+
+	// Path is the path of the folder. For environment sources it is the prefix
+	// of the environment variable names and for data sources it is the name
+	// which identifies the source of the data.
+	Path string
+
+	// Data is the raw data of data sources.
+	Data []byte
+
+	// OfflineOnly restricts the source to licenses which can be validated with
+	// the certificate chain included in the license. Such licenses are never
+	// validated with online keys.
+	OfflineOnly bool
+}
+
+// ParseLicenseSource parses the provided value in the form of PATH[:OPTION]
+// and returns the matching LicenseSource.
+func ParseLicenseSource(value string) (*LicenseSource, error) {
+	src := &LicenseSource{
+		Path: value,
+	}
+	if idx := strings.LastIndex(value, ":"); idx >= 0 {
+		switch value[idx+1:] {
+		case LicenseSourceOfflineOnly:
+			src.OfflineOnly = true
+			src.Path = value[:idx]
+		}
+	}
+	if src.Path == "" {
+		return nil, fmt.Errorf("license source path is empty")
+	}
+
+	return src, nil
+}
+
+// NewLicenseSourceFromReader reads all data from the provided reader once and
+// returns a data source with the provided name for it.
+func NewLicenseSourceFromReader(name string, r io.Reader) (*LicenseSource, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, licenseSizeLimitBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	return &LicenseSource{
+		Type: LicenseSourceTypeData,
+		Path: name,
+		Data: data,
+	}, nil
+}
+
+// String returns the string representation of the associated source, as it
+// is used for logging and reporting.
+func (src *LicenseSource) String() string {
+	switch src.Type {
+	case LicenseSourceTypeEnv:
+		return string(src.Type) + ":" + src.Path
+	case LicenseSourceTypeData:
+		return src.Path
+	}
+	if src.OfflineOnly {
+		return src.Path + ":" + LicenseSourceOfflineOnly
+	}
+	return src.Path
+}
@@ -0,0 +1,305 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-or-later
+ * Copyright 2021 Kopano and its licensors
+ */
+
+package kustomer
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func newTestLicenseFolder(t *testing.T, files map[string][]byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "kustomer-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, raw := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), raw, 0600); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseLicenseSource(t *testing.T) {
+	for _, tc := range []struct {
+		value       string
+		path        string
+		offlineOnly bool
+		str         string
+		err         bool
+	}{
+		{"/etc/kopano/licenses", "/etc/kopano/licenses", false, "/etc/kopano/licenses", false},
+		{"/etc/kopano/licenses:offline", "/etc/kopano/licenses", true, "/etc/kopano/licenses:offline", false},
+		{"/etc/kopano/licenses:other", "/etc/kopano/licenses:other", false, "/etc/kopano/licenses:other", false},
+		{"/srv/a:b/licenses:offline", "/srv/a:b/licenses", true, "/srv/a:b/licenses:offline", false},
+		{"/srv/a:offline/licenses", "/srv/a:offline/licenses", false, "/srv/a:offline/licenses", false},
+		{":offline", "", false, "", true},
+		{"", "", false, "", true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			src, err := ParseLicenseSource(tc.value)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got %+v", src)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if src.Path != tc.path {
+				t.Errorf("expected path %q, got %q", tc.path, src.Path)
+			}
+			if src.Type != LicenseSourceTypeFolder {
+				t.Errorf("expected folder source, got %q", src.Type)
+			}
+			if src.OfflineOnly != tc.offlineOnly {
+				t.Errorf("expected offline only %v, got %v", tc.offlineOnly, src.OfflineOnly)
+			}
+			if str := src.String(); str != tc.str {
+				t.Errorf("expected string %q, got %q", tc.str, str)
+			}
+		})
+	}
+}
+
+func TestScanSourcesPrecedence(t *testing.T) {
+	loader, privateKey := newTestLicensesLoader(t)
+
+	newLicense := func(id, sub string) []byte {
+		claims := newTestLicenseClaims(id)
+		claims.Subject = sub
+		return signTestLicense(t, privateKey, claims)
+	}
+	first, cleanupFirst := newTestLicenseFolder(t, map[string][]byte{
+		"shared.license":     newLicense("shared", "first"),
+		"only-first.license": newLicense("only-first", "first"),
+	})
+	defer cleanupFirst()
+	second, cleanupSecond := newTestLicenseFolder(t, map[string][]byte{
+		"shared.license":      newLicense("shared", "second"),
+		"only-second.license": newLicense("only-second", "second"),
+	})
+	defer cleanupSecond()
+	subs := map[string]string{
+		first:  "first",
+		second: "second",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		sources  []*LicenseSource
+		expected map[string]string
+	}{
+		{"first wins", []*LicenseSource{{Path: first}, {Path: second}}, map[string]string{
+			"shared":      first,
+			"only-first":  first,
+			"only-second": second,
+		}},
+		{"reversed", []*LicenseSource{{Path: second}, {Path: first}}, map[string]string{
+			"shared":      second,
+			"only-first":  first,
+			"only-second": second,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := loader.Scan(tc.sources, jwt.Expected{
+				Time: time.Now(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != len(tc.expected) {
+				t.Fatalf("expected %d licenses, got %d", len(tc.expected), len(result))
+			}
+			for _, c := range result {
+				source, ok := tc.expected[c.LicenseID]
+				if !ok {
+					t.Errorf("unexpected license %s", c.LicenseID)
+					continue
+				}
+				if c.LicenseSource != source {
+					t.Errorf("expected license %s from %s, got %s", c.LicenseID, source, c.LicenseSource)
+				}
+				if filepath.Dir(c.LicenseFileName) != source {
+					t.Errorf("expected license %s file in %s, got %s", c.LicenseID, source, c.LicenseFileName)
+				}
+				if c.Claims.Subject != subs[source] {
+					t.Errorf("expected license %s claims from %s, got sub %s", c.LicenseID, source, c.Claims.Subject)
+				}
+			}
+		})
+	}
+}
+
+func TestScanSourcesOfflineOnly(t *testing.T) {
+	now := time.Now()
+	root, signer := newTestCertificateChain(t, now)
+	certPool := x509.NewCertPool()
+	certPool.AddCert(root.cert)
+
+	loader, privateKey := newTestLicensesLoader(t)
+	loader.CertPool = certPool
+
+	dir, cleanup := newTestLicenseFolder(t, map[string][]byte{
+		"online.license":  signTestLicense(t, privateKey, newTestLicenseClaims("online")),
+		"offline.license": signTestLicenseWithCertificates(t, signer, []*x509.Certificate{signer.cert}, newTestLicenseClaims("offline")),
+	})
+	defer cleanup()
+
+	for _, tc := range []struct {
+		name     string
+		source   *LicenseSource
+		expected string
+	}{
+		{"any", &LicenseSource{Path: dir}, "online"},
+		{"offline only", &LicenseSource{Path: dir, OfflineOnly: true}, "offline"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := loader.Scan([]*LicenseSource{tc.source}, jwt.Expected{
+				Time: now,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != 1 || result[0].LicenseID != tc.expected {
+				t.Fatalf("expected only license %s, got %d licenses", tc.expected, len(result))
+			}
+			if result[0].LicenseSource != tc.source.String() {
+				t.Errorf("expected source %s, got %s", tc.source, result[0].LicenseSource)
+			}
+		})
+	}
+}
+
+func TestScanSourcesFailed(t *testing.T) {
+	loader, privateKey := newTestLicensesLoader(t)
+
+	dir, cleanup := newTestLicenseFolder(t, map[string][]byte{
+		"a.license": signTestLicense(t, privateKey, newTestLicenseClaims("a")),
+	})
+	defer cleanup()
+	missing := filepath.Join(dir, "missing")
+
+	result, err := loader.Scan([]*LicenseSource{{Path: missing}, {Path: dir}}, jwt.Expected{
+		Time: time.Now(),
+	})
+	if err != nil {
+		t.Errorf("expected no error when any source can be scanned, got %v", err)
+	}
+	if len(result) != 1 || result[0].LicenseID != "a" {
+		t.Errorf("expected license from the remaining source, got %d licenses", len(result))
+	}
+
+	if _, err = loader.Scan([]*LicenseSource{{Path: missing}}, jwt.Expected{
+		Time: time.Now(),
+	}); err == nil {
+		t.Errorf("expected error when no source can be scanned")
+	}
+}
+
+func TestScanSourcesEnvAndReader(t *testing.T) {
+	loader, privateKey := newTestLicensesLoader(t)
+
+	newLicense := func(id, sub string) []byte {
+		claims := newTestLicenseClaims(id)
+		claims.Subject = sub
+		return signTestLicense(t, privateKey, claims)
+	}
+	env := map[string][]byte{
+		"KOPANO_LICENSE_TEST_A": newLicense("env-a", "env"),
+		"KOPANO_LICENSE_TEST_B": bytes.Join([][]byte{newLicense("env-b", "env"), newLicense("shared", "env")}, []byte("\n")),
+		"KOPANO_LICENSE_":       newLicense("env-prefix", "env"),
+		"KOPANO_LICENSES_TEST":  newLicense("env-other", "env"),
+	}
+	for k, v := range env {
+		if err := os.Setenv(k, string(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}()
+	envSource := &LicenseSource{
+		Type: LicenseSourceTypeEnv,
+		Path: "KOPANO_LICENSE_",
+	}
+
+	stdinSource, err := NewLicenseSourceFromReader("stdin", bytes.NewReader(newLicense("shared", "stdin")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type expected struct {
+		fileName string
+		source   string
+		sub      string
+	}
+	for _, tc := range []struct {
+		name     string
+		sources  []*LicenseSource
+		expected map[string]expected
+	}{
+		{"env", []*LicenseSource{envSource}, map[string]expected{
+			"env-a":  {"env:KOPANO_LICENSE_TEST_A", "env:KOPANO_LICENSE_", "env"},
+			"env-b":  {"env:KOPANO_LICENSE_TEST_B", "env:KOPANO_LICENSE_", "env"},
+			"shared": {"env:KOPANO_LICENSE_TEST_B", "env:KOPANO_LICENSE_", "env"},
+		}},
+		{"stdin", []*LicenseSource{stdinSource}, map[string]expected{
+			"shared": {"stdin", "stdin", "stdin"},
+		}},
+		{"stdin first", []*LicenseSource{stdinSource, envSource}, map[string]expected{
+			"env-a":  {"env:KOPANO_LICENSE_TEST_A", "env:KOPANO_LICENSE_", "env"},
+			"env-b":  {"env:KOPANO_LICENSE_TEST_B", "env:KOPANO_LICENSE_", "env"},
+			"shared": {"stdin", "stdin", "stdin"},
+		}},
+		{"env first", []*LicenseSource{envSource, stdinSource}, map[string]expected{
+			"env-a":  {"env:KOPANO_LICENSE_TEST_A", "env:KOPANO_LICENSE_", "env"},
+			"env-b":  {"env:KOPANO_LICENSE_TEST_B", "env:KOPANO_LICENSE_", "env"},
+			"shared": {"env:KOPANO_LICENSE_TEST_B", "env:KOPANO_LICENSE_", "env"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, scanErr := loader.Scan(tc.sources, jwt.Expected{
+				Time: time.Now(),
+			})
+			if scanErr != nil {
+				t.Fatal(scanErr)
+			}
+			if len(result) != len(tc.expected) {
+				t.Fatalf("expected %d licenses, got %d", len(tc.expected), len(result))
+			}
+			for _, c := range result {
+				e, ok := tc.expected[c.LicenseID]
+				if !ok {
+					t.Errorf("unexpected license %s", c.LicenseID)
+					continue
+				}
+				if c.LicenseFileName != e.fileName {
+					t.Errorf("expected license %s file name %s, got %s", c.LicenseID, e.fileName, c.LicenseFileName)
+				}
+				if c.LicenseSource != e.source {
+					t.Errorf("expected license %s source %s, got %s", c.LicenseID, e.source, c.LicenseSource)
+				}
+				if c.Claims.Subject != e.sub {
+					t.Errorf("expected license %s sub %s, got %s", c.LicenseID, e.sub, c.Claims.Subject)
+				}
+			}
+		})
+	}
+}